@@ -0,0 +1,25 @@
+// Event limits from config
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// Builds the per event type limits from the limits config, keyed by event
+// type, e.g limits.stop.debounce
+func eventLimits() map[string]events.Limit {
+	limits := make(map[string]events.Limit)
+	for eventType := range viper.GetStringMap("limits") {
+		key := fmt.Sprintf("limits.%s.", eventType)
+		limits[eventType] = events.Limit{
+			Debounce: viper.GetDuration(key + "debounce"),
+			Rate:     viper.GetInt(key + "rate"),
+			Interval: viper.GetDuration(key + "interval"),
+		}
+	}
+	return limits
+}
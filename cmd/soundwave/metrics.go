@@ -0,0 +1,30 @@
+// Metrics and status endpoints
+
+package main
+
+import (
+	"encoding/json"
+	_ "expvar" // Registers /debug/vars
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// Serves expvar metrics on /debug/vars, recent rejected messages on
+// /dead-letters and the player and connection status on /status
+func serveMetrics(addr string, deadLetters *events.DeadLetters, st *status) {
+	http.HandleFunc("/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deadLetters.Recent())
+	})
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st.report())
+	})
+
+	log.Infof("Serving metrics on: %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Errorf("Metrics server error: %s", err)
+	}
+}
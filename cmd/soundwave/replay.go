@@ -0,0 +1,215 @@
+// Replay Command
+//
+// Feeds the inbound events recorded in a journal into a player that plays
+// through a fake engine and a fake Perceptor, so the order events arrived in
+// can be reproduced without Spotify or Perceptor.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/journal"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+	"github.com/thisissoon/FM-SoundWave/player"
+)
+
+var replaySpeed float64
+
+var replayCmdLongDesc = `Replays the inbound events recorded in a journal into a player with a fake
+track source and audio engine. Tracks are played in the order the journal
+recorded them being loaded and end when the journal recorded them ending.`
+
+var ReplayCmd = &cobra.Command{
+	Use:   "replay <journal>",
+	Short: "Replay the events recorded in a journal",
+	Long:  replayCmdLongDesc,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.SetLevel(log.DebugLevel)
+
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		entries, err := readJournal(args[0])
+		if err != nil {
+			log.Fatalf("Failed to read journal: %s", err)
+		}
+		if len(entries) == 0 {
+			log.Fatalf("Journal is empty: %s", args[0])
+		}
+
+		// Make the player with fakes for Perceptor and Spotify
+		bus := events.NewBus()
+		handler := events.NewHandler(bus)
+		go handler.Run(context.Background())
+		source := newReplaySource(entries)
+		engine := newReplayEngine()
+		p := player.NewWithEngine(engine, player.Timeouts{}, source, bus)
+		changes := p.Subscribe()
+		go func() {
+			for change := range changes {
+				log.Infof("Replay State: %s -> %s (%s)", change.From, change.To, change.Trigger)
+			}
+		}()
+		go p.Run(context.Background())
+
+		// Feed the entries in at their recorded pace
+		start := time.Now()
+		first := entries[0].Time
+		for _, e := range entries {
+			if replaySpeed > 0 {
+				offset := time.Duration(float64(e.Time.Sub(first)) / replaySpeed)
+				time.Sleep(offset - time.Since(start))
+			}
+			switch e.Kind {
+			case journal.INBOUND_ENTRY:
+				log.Infof("Replay Inbound: %s", e.Data)
+				handler.ReceiveChannel() <- []byte(e.Data)
+			case journal.STATE_ENTRY:
+				change := &player.StateChange{}
+				if err := json.Unmarshal(e.Data, change); err != nil {
+					log.Errorf("Invalid state entry: %s", err)
+					continue
+				}
+				log.Infof("Recorded State: %s -> %s (%s)", change.From, change.To, change.Trigger)
+				if change.Trigger == player.END_TRIGGER {
+					engine.end()
+				}
+			}
+		}
+
+		// Give the player a moment to act on the final events
+		time.Sleep(time.Second)
+	},
+}
+
+func init() {
+	ReplayCmd.Flags().Float64VarP(&replaySpeed, "speed", "s", 1,
+		"Speed to replay at, 2 is twice as fast, 0 is as fast as possible")
+	SoundWaveCmd.AddCommand(ReplayCmd)
+}
+
+// Reads every entry from the journal
+func readJournal(path string) ([]*journal.Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*journal.Entry
+	r := journal.NewReader(f)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// Fake Perceptor serving the tracks the journal recorded being loaded
+type replaySource struct {
+	lock   sync.Mutex
+	tracks []*perceptor.Track
+}
+
+func (s *replaySource) Next() (*perceptor.Track, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tracks) == 0 {
+		return nil, errors.New("no more tracks in journal")
+	}
+	t := s.tracks[0]
+	s.tracks = s.tracks[1:]
+	return t, nil
+}
+
+func (s *replaySource) Play(t *perceptor.Track, start time.Time) {
+	log.Infof("Replay Outbound: play %s", t.Uri)
+}
+
+func (s *replaySource) Pause(start time.Time) {
+	log.Info("Replay Outbound: pause")
+}
+
+func (s *replaySource) Resume(duration int64) {
+	log.Infof("Replay Outbound: resume after %dms", duration)
+}
+
+func (s *replaySource) End(t *perceptor.Track) {
+	log.Infof("Replay Outbound: end %s", t.Uri)
+}
+
+func (s *replaySource) Error(t *perceptor.Track, stage string, message string) {
+	log.Infof("Replay Outbound: error %s at %s: %s", t.Uri, stage, message)
+}
+
+// Events come from the journal rather than a stream
+func (s *replaySource) WSConnection(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// Constructs a replaySource from the tracks loaded in the journal
+func newReplaySource(entries []*journal.Entry) *replaySource {
+	s := &replaySource{}
+	for _, e := range entries {
+		if e.Kind != journal.STATE_ENTRY {
+			continue
+		}
+		change := &player.StateChange{}
+		if err := json.Unmarshal(e.Data, change); err == nil && change.Trigger == player.LOAD_TRIGGER {
+			s.tracks = append(s.tracks, change.Track)
+		}
+	}
+	return s
+}
+
+// Fake engine that plays silence, tracks end when the journal says they did
+type replayEngine struct {
+	eot chan struct{}
+}
+
+func (e *replayEngine) Load(uri string) error {
+	log.Infof("Replay Engine: load %s", uri)
+	return nil
+}
+
+func (e *replayEngine) Play()                       {}
+func (e *replayEngine) Pause()                      {}
+func (e *replayEngine) Unload()                     {}
+func (e *replayEngine) EndOfTrack() <-chan struct{} { return e.eot }
+func (e *replayEngine) LastWrite() time.Time        { return time.Now() }
+func (e *replayEngine) SetVolume(vol int)           {}
+func (e *replayEngine) Close() error                { return nil }
+
+func (e *replayEngine) FadeOut(ctx context.Context, d time.Duration) {}
+
+// Ends the loaded track
+func (e *replayEngine) end() {
+	select {
+	case e.eot <- struct{}{}:
+	default:
+	}
+}
+
+// Constructs a new replayEngine
+func newReplayEngine() *replayEngine {
+	return &replayEngine{
+		eot: make(chan struct{}, 1),
+	}
+}
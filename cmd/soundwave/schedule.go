@@ -0,0 +1,32 @@
+// Scheduled actions from config
+
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thisissoon/FM-SoundWave/schedule"
+)
+
+// Builds the scheduled rules from the schedule config, keyed by rule name,
+// e.g schedule.all_hands.cron
+func scheduleRules() []*schedule.Rule {
+	var rules []*schedule.Rule
+	for name := range viper.GetStringMap("schedule") {
+		key := fmt.Sprintf("schedule.%s.", name)
+		r, err := schedule.NewRule(
+			name,
+			viper.GetString(key+"cron"),
+			viper.GetString(key+"action"),
+			viper.GetInt(key+"volume"),
+			viper.GetStringSlice(key+"playlist"),
+			viper.GetDuration(key+"duration"))
+		if err != nil {
+			log.Fatalf("Invalid schedule: %s", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
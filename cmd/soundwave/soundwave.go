@@ -5,15 +5,23 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/journal"
 	"github.com/thisissoon/FM-SoundWave/perceptor"
 	"github.com/thisissoon/FM-SoundWave/player"
+	"github.com/thisissoon/FM-SoundWave/schedule"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/spool"
+	"github.com/thisissoon/FM-SoundWave/tlsutil"
 )
 
 var soundWaveCmdLongDesc = `Sound Wave Plays Spotify Music for SOON_ FM`
@@ -26,60 +34,338 @@ var SoundWaveCmd = &cobra.Command{
 		// Set log level
 		log.SetLevel(log.DebugLevel)
 
-		// Make event channels
-		channels := events.NewChannels()
+		// Open the event journal
+		var j *journal.Journal
+		if path := viper.GetString("journal.path"); path != "" {
+			var err error
+			j, err = journal.Open(
+				path,
+				int64(viper.GetInt("journal.max_size")),
+				viper.GetInt("journal.max_files"))
+			if err != nil {
+				log.Fatalf("Failed to open journal: %s", err)
+			}
+		}
+
+		// Cancelled to shutdown
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// Make event bus
+		bus := events.NewBus()
+
+		// Track connection status from the start
+		st := newStatus(bus)
 
 		// Make Event Handler
-		handler := events.NewHandler(channels)
-		go handler.Run()
+		handler := events.NewHandler(bus)
 
 		// Create Perceptor
 		pcptr := perceptor.New(
 			viper.GetString("perceptor_address"),
 			viper.GetString("secret"),
 			handler.ReceiveChannel(),
-			channels)
-		go pcptr.WSConnection()
+			bus)
+		pcptr.SetJournal(j)
+		pcptr.SetHealthCheck(perceptor.HealthCheck{
+			Interval: viper.GetDuration("perceptor_health.interval"),
+			Timeout:  viper.GetDuration("perceptor_health.timeout"),
+			Rise:     viper.GetInt("perceptor_health.rise"),
+			Path:     viper.GetString("perceptor_health.path"),
+		})
+		pcptr.SetEndpoints(viper.GetStringSlice("perceptor_addresses"))
+		pcptr.SetSigner(signature.NewSigner(
+			viper.GetInt("signing.version"),
+			viper.GetString("signing.client_id"),
+			append([]string{viper.GetString("secret")}, viper.GetStringSlice("signing.previous_secrets")...),
+			viper.GetDuration("signing.max_age")))
+		if viper.GetString("perceptor_scheme") == "https" {
+			config, err := tlsutil.Config{
+				CA:         viper.GetString("perceptor_tls.ca"),
+				Cert:       viper.GetString("perceptor_tls.cert"),
+				Key:        viper.GetString("perceptor_tls.key"),
+				ServerName: viper.GetString("perceptor_tls.server_name"),
+			}.Load()
+			if err != nil {
+				log.Fatalf("Failed to load Perceptor TLS config: %s", err)
+			}
+			pcptr.SetTLS(config)
+		}
+		pcptr.SetKeepalive(perceptor.Keepalive{
+			PingInterval: viper.GetDuration("websocket.ping_interval"),
+			ReadTimeout:  viper.GetDuration("websocket.read_timeout"),
+			WriteTimeout: viper.GetDuration("websocket.write_timeout"),
+			MinBackoff:   viper.GetDuration("websocket.min_backoff"),
+			MaxBackoff:   viper.GetDuration("websocket.max_backoff"),
+		})
+		handler.SetAcker(pcptr)
+
+		// Deliver events to Perceptor through the outbox, delivery carries
+		// on after shutdown starts so the final events can be flushed
+		if path := viper.GetString("outbox.path"); path != "" {
+			outbox, err := spool.Open(path, viper.GetInt("outbox.max_size"))
+			if err != nil {
+				log.Fatalf("Failed to open outbox: %s", err)
+			}
+			pcptr.SetOutbox(outbox)
+		}
+		delivery, stopDelivery := context.WithCancel(context.Background())
+		go pcptr.DeliverEvents(delivery)
+		if !viper.GetBool("standalone.enabled") {
+			go pcptr.MonitorEndpoints(delivery)
+		}
+
+		// Collect rejected messages, recording them to their own journal or
+		// the event journal
+		var deadLetterSink events.Recorder
+		if j != nil {
+			deadLetterSink = j
+		}
+		if path := viper.GetString("dead_letters.path"); path != "" {
+			dl, err := journal.Open(
+				path,
+				int64(viper.GetInt("journal.max_size")),
+				viper.GetInt("journal.max_files"))
+			if err != nil {
+				log.Fatalf("Failed to open dead letter journal: %s", err)
+			}
+			deadLetterSink = dl
+		}
+		deadLetters := events.NewDeadLetters(
+			deadLetterSink,
+			pcptr,
+			viper.GetBool("dead_letters.strict"))
+		handler.SetDeadLetters(deadLetters)
+		pcptr.SetVerifyInbound(viper.GetBool("signing.verify_inbound"), deadLetters)
+		handler.Use(
+			events.Logging(),
+			events.Metrics(),
+			events.Throttle(events.NewLimiter(eventLimits())))
+		go handler.Run(ctx)
+
+		// Take tracks from Perceptor, or from the local queue in standalone
+		// mode
+		var source perceptor.Client = pcptr
+		if viper.GetBool("standalone.enabled") {
+			source = startStandalone(bus)
+		}
 
 		// Create Player
 		player, err := player.New(
 			viper.GetString("spotify.user"),
 			viper.GetString("spotify.pass"),
 			viper.GetString("spotify.key"),
-			pcptr,
-			channels)
+			player.Timeouts{
+				Parse: viper.GetDuration("timeouts.parse"),
+				Load:  viper.GetDuration("timeouts.load"),
+				Stall: viper.GetDuration("timeouts.stall"),
+			},
+			source,
+			bus)
 		if err != nil {
 			// Exit on error
 			log.Fatalf("Failed to create player: %s", err)
 		}
+		player.SetFadeOut(viper.GetDuration("shutdown.fade"))
+
+		// Connect to Perceptor once the player can report its status
+		if viper.GetBool("websocket.send_events") {
+			pcptr.SetWebsocketEvents(
+				player.Status,
+				viper.GetDuration("websocket.heartbeat_interval"),
+				viper.GetDuration("websocket.receipt_timeout"))
+		}
+		if transportEnabled("websocket") && !viper.GetBool("standalone.enabled") {
+			go pcptr.WSConnection(ctx)
+		}
+
 		// Run the player - this will play the music
-		go player.Run()
+		stopped := make(chan struct{})
+		go func() {
+			player.Run(ctx)
+			close(stopped)
+		}()
+
+		// Serve metrics
+		st.setPlayer(player)
+		if addr := viper.GetString("metrics_address"); addr != "" {
+			go serveMetrics(addr, deadLetters, st)
+		}
+
+		// Record player state changes to the journal
+		if j != nil {
+			changes := player.Subscribe()
+			go func() {
+				for change := range changes {
+					j.Record(journal.STATE_ENTRY, string(change.Trigger), change)
+				}
+			}()
+		}
+
+		// Send scheduled events
+		if rules := scheduleRules(); len(rules) > 0 {
+			go schedule.New(schedule.NewClock(), rules, handler.ReceiveChannel()).Run(ctx)
+		}
+
+		// Send player events to webhooks, carrying on after shutdown starts
+		// like the outbox so the final events can be flushed
+		hooks := startWebhooks(delivery, player)
+
+		// Start the optional event transports
+		if transportEnabled("redis") {
+			startRedis(handler, bus, player)
+		}
+		if transportEnabled("mqtt") {
+			startMQTT(handler, bus, player)
+		}
 
 		// Channel to listen for OS Signals
 		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, os.Interrupt, os.Kill)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 		// Run for ever unless we get a signal
-		for sig := range signals {
-			log.Println(sig)
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		cancel()
+
+		// Wait for the player to stop the current track, a second signal
+		// exits straight away
+		deadline, done := shutdownDeadline(viper.GetDuration("shutdown.timeout"))
+		defer done()
+		select {
+		case <-stopped:
+		case <-deadline.Done():
+			log.Warn("Shutdown deadline passed, exiting")
+		case sig := <-signals:
+			log.Warnf("Received %s, exiting", sig)
 			os.Exit(1)
 		}
+
+		// Deliver the final events
+		if err := pcptr.Flush(deadline); err != nil {
+			log.Warnf("Failed to flush outbox: %s", err)
+		}
+		for _, w := range hooks {
+			if err := w.Flush(deadline); err != nil {
+				log.Warnf("Failed to flush webhook: %s", err)
+			}
+		}
+		stopDelivery()
+
+		// Close the Spotify session and PortAudio
+		closed := make(chan error, 1)
+		go func() {
+			closed <- player.Close()
+		}()
+		select {
+		case err := <-closed:
+			if err != nil {
+				log.Errorf("Failed to close player: %s", err)
+			}
+		case <-deadline.Done():
+			log.Warn("Shutdown deadline passed, exiting")
+		}
+		j.Close()
+		os.Exit(0)
 	},
 }
 
+// Returns the context shutdown must finish within, a timeout of 0 waits for
+// as long as shutdown takes
+func shutdownDeadline(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
 func init() {
 	// Load config from File
 	log.SetLevel(log.WarnLevel)
 
 	// Defaults
 	viper.SetDefault("perceptor_address", "localhost:9000")
+	viper.SetDefault("perceptor_scheme", "http")        // https connects over https and wss
+	viper.SetDefault("perceptor_addresses", []string{}) // Failover endpoints, primary first
+	viper.SetDefault("perceptor_health", map[string]interface{}{
+		"interval": "10s", // Check every endpoint this often
+		"timeout":  "2s",
+		"rise":     3, // Passed checks before a failed endpoint is used again
+		"path":     "/health",
+	})
 	viper.SetDefault("secret", "foo")
+	viper.SetDefault("signing", map[string]interface{}{
+		"version":          1, // 2 signs the method, path and a timestamp
+		"client_id":        "soundwave",
+		"max_age":          "5m",       // Reject version 2 signatures older than this
+		"previous_secrets": []string{}, // Still accepted whilst rotating the secret
+		"verify_inbound":   false,      // Only accept signed websocket messages
+	})
 	viper.SetDefault("log_level", "warn")
 	viper.SetDefault("spotify", map[string]string{
 		"user": "CHANGE_ME",
 		"pass": "CHANGE_ME",
 		"key":  "CHANGE_ME",
 	})
+	viper.SetDefault("timeouts", map[string]string{
+		"parse": "10s", // Parsing a track URI
+		"load":  "30s", // Loading track metadata
+		"stall": "15s", // No audio delivered during playback
+	})
+	viper.SetDefault("websocket", map[string]string{
+		"ping_interval": "30s", // Ping Perceptor this often
+		"read_timeout":  "60s", // Reconnect when nothing is read for this long
+		"write_timeout": "10s",
+		"min_backoff":   "1s", // Reconnection backoff
+		"max_backoff":   "1m",
+	})
+	viper.SetDefault("websocket.send_events", false)
+	viper.SetDefault("websocket.heartbeat_interval", "10s")
+	viper.SetDefault("websocket.receipt_timeout", "5s") // POST events Perceptor has not received
+	viper.SetDefault("shutdown", map[string]string{
+		"timeout": "10s", // Exit even if the player has not stopped
+		"fade":    "2s",  // Fade out the playing track
+	})
+	viper.SetDefault("journal", map[string]interface{}{
+		"path":      "",       // Journal disabled when empty
+		"max_size":  10 << 20, // Rotate after 10MB
+		"max_files": 5,
+	})
+	viper.SetDefault("dead_letters", map[string]interface{}{
+		"path":   "",    // Recorded to the journal when empty
+		"strict": false, // Report unsupported event types to Perceptor
+	})
+	viper.SetDefault("limits.stop.debounce", "2s") // Collapse skips sent together
+	viper.SetDefault("outbox", map[string]interface{}{
+		"path":     "", // Queued in memory when empty
+		"max_size": 10000,
+	})
+	viper.SetDefault("webhook_queue", map[string]interface{}{
+		"path":     "", // Queued in memory when empty
+		"max_size": 1000,
+	})
+	viper.SetDefault("standalone", map[string]interface{}{
+		"enabled": false, // Play from the local queue instead of Perceptor
+		"path":    "",    // Queue kept in memory when empty
+		"address": "127.0.0.1:8090",
+	})
+	viper.SetDefault("metrics_address", "")
+	viper.SetDefault("transports", []string{"websocket"})
+	viper.SetDefault("redis", map[string]string{
+		"address":        "127.0.0.1:6379",
+		"channel":        "soundwave",
+		"events_channel": "soundwave:events",
+	})
+	viper.SetDefault("mqtt.broker", "tcp://127.0.0.1:1883")
+	viper.SetDefault("mqtt.client_id", "soundwave")
+	viper.SetDefault("mqtt.qos", 1)
+	viper.SetDefault("mqtt.topics", map[string]string{
+		"pause":       "soundwave/pause",
+		"resume":      "soundwave/resume",
+		"skip":        "soundwave/skip",
+		"volume":      "soundwave/volume",
+		"now_playing": "soundwave/now_playing",
+		"status":      "soundwave/status",
+	})
 
 	// From file
 	viper.SetConfigName("config")           // name of config file (without extension)
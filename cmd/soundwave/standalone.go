@@ -0,0 +1,25 @@
+// Standalone mode with a local queue
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/standalone"
+)
+
+// Opens the local queue the player takes tracks from in place of Perceptor
+// and serves its API
+func startStandalone(bus *events.Bus) *standalone.Queue {
+	q, err := standalone.Open(viper.GetString("standalone.path"), bus)
+	if err != nil {
+		log.Fatalf("Failed to open queue: %s", err)
+	}
+	go func() {
+		if err := standalone.Serve(viper.GetString("standalone.address"), q); err != nil {
+			log.Errorf("Queue API error: %s", err)
+		}
+	}()
+	return q
+}
@@ -0,0 +1,80 @@
+// Status of SoundWave and its connections
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/player"
+)
+
+// Status of a connection to an event service
+type connectionStatus struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Tracks the player state and the state of each connection from the
+// connection events on the bus
+type status struct {
+	lock        sync.Mutex
+	player      *player.Player
+	connections map[string]*connectionStatus
+}
+
+// Status served on /status
+type statusReport struct {
+	Player      string                       `json:"player"`
+	Connections map[string]*connectionStatus `json:"connections"`
+}
+
+// Sets the player whose state is reported
+func (s *status) setPlayer(p *player.Player) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.player = p
+}
+
+// Returns the current status
+func (s *status) report() *statusReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := &statusReport{
+		Player:      "starting",
+		Connections: make(map[string]*connectionStatus),
+	}
+	if s.player != nil {
+		r.Player = s.player.State().String()
+	}
+	for addr, c := range s.connections {
+		copy := *c
+		r.Connections[addr] = &copy
+	}
+	return r
+}
+
+// Updates connection states from connection events
+func (s *status) watch(sub *events.Subscription) {
+	for e := range sub.Events() {
+		c := e.(*events.ConnectionEvent)
+		s.lock.Lock()
+		s.connections[c.Addr] = &connectionStatus{
+			Connected: c.Connected,
+			Since:     c.Timestamp,
+			Error:     c.Error,
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Constructs a new status watching connection events on the bus
+func newStatus(bus *events.Bus) *status {
+	s := &status{
+		connections: make(map[string]*connectionStatus),
+	}
+	go s.watch(bus.Subscribe("status", 8, events.DROP_POLICY, events.CONNECTION_EVENT))
+	return s
+}
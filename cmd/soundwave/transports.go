@@ -0,0 +1,87 @@
+// Optional event transports
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/mqtt"
+	"github.com/thisissoon/FM-SoundWave/player"
+	"github.com/thisissoon/FM-SoundWave/pubsub"
+	"github.com/thisissoon/FM-SoundWave/tlsutil"
+)
+
+// Returns true if the event transport is enabled in config
+func transportEnabled(name string) bool {
+	for _, t := range viper.GetStringSlice("transports") {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Receives control events and publishes player events over Redis
+func startRedis(handler *events.Handler, bus *events.Bus, p *player.Player) {
+	redis := pubsub.New(
+		viper.GetString("redis.address"),
+		viper.GetString("redis.channel"),
+		viper.GetString("redis.events_channel"),
+		handler.ReceiveChannel(),
+		bus)
+	go redis.Subscribe()
+
+	changes := p.Subscribe()
+	go func() {
+		for change := range changes {
+			if e := change.Event(); e != nil {
+				if err := redis.Publish(e); err != nil {
+					log.Errorf("Failed to publish to Redis: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// Receives commands and publishes now playing state over MQTT
+func startMQTT(handler *events.Handler, bus *events.Bus, p *player.Player) {
+	m, err := mqtt.New(mqtt.Config{
+		Broker:   viper.GetString("mqtt.broker"),
+		ClientId: viper.GetString("mqtt.client_id"),
+		Username: viper.GetString("mqtt.username"),
+		Password: viper.GetString("mqtt.password"),
+		QoS:      byte(viper.GetInt("mqtt.qos")),
+		Topics: mqtt.Topics{
+			Pause:      viper.GetString("mqtt.topics.pause"),
+			Resume:     viper.GetString("mqtt.topics.resume"),
+			Skip:       viper.GetString("mqtt.topics.skip"),
+			Volume:     viper.GetString("mqtt.topics.volume"),
+			NowPlaying: viper.GetString("mqtt.topics.now_playing"),
+			Status:     viper.GetString("mqtt.topics.status"),
+		},
+		TLS: tlsutil.Config{
+			CA:         viper.GetString("mqtt.tls.ca"),
+			Cert:       viper.GetString("mqtt.tls.cert"),
+			Key:        viper.GetString("mqtt.tls.key"),
+			ServerName: viper.GetString("mqtt.tls.server_name"),
+		},
+	}, handler.ReceiveChannel(), bus)
+	if err != nil {
+		log.Fatalf("Failed to create MQTT client: %s", err)
+	}
+
+	changes := p.Subscribe()
+	go func() {
+		m.Connect()
+		for change := range changes {
+			track := change.Track
+			if change.To == player.IDLE_STATE {
+				track = nil
+			}
+			if err := m.NowPlaying(change.To.String(), track, change.Time); err != nil {
+				log.Errorf("Failed to publish to MQTT: %s", err)
+			}
+		}
+	}()
+}
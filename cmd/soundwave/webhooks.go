@@ -0,0 +1,74 @@
+// Outbound webhooks from config
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thisissoon/FM-SoundWave/player"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/spool"
+	"github.com/thisissoon/FM-SoundWave/webhook"
+)
+
+// Sends player events to the webhooks in config, keyed by hook name, e.g
+// webhooks.slack.url, until the context is done. Returns the webhooks so
+// they can be flushed on shutdown.
+func startWebhooks(ctx context.Context, p *player.Player) []*webhook.Webhook {
+	var hooks []*webhook.Webhook
+	for name := range viper.GetStringMap("webhooks") {
+		key := fmt.Sprintf("webhooks.%s.", name)
+
+		// Each hook has its own queue so one that is down can not hold up
+		// the others
+		dir := viper.GetString("webhook_queue.path")
+		if dir != "" {
+			dir = filepath.Join(dir, name)
+		}
+		s, err := spool.Open(dir, viper.GetInt("webhook_queue.max_size"))
+		if err != nil {
+			log.Fatalf("Failed to open webhook queue: %s", err)
+		}
+
+		// Signed the same way as requests to Perceptor, with the hook's
+		// own secret
+		var signer *signature.Signer
+		if secret := viper.GetString(key + "secret"); secret != "" {
+			signer = signature.NewSigner(
+				viper.GetInt("signing.version"),
+				viper.GetString("signing.client_id"),
+				[]string{secret},
+				0)
+		}
+
+		w := webhook.New(webhook.Hook{
+			Name:   name,
+			URL:    viper.GetString(key + "url"),
+			Signer: signer,
+			Events: viper.GetStringSlice(key + "events"),
+		}, s)
+		go w.Run(ctx)
+		hooks = append(hooks, w)
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	// Observed rather than subscribed so no event is ever dropped
+	p.Observe(func(change player.StateChange) {
+		e := change.Event()
+		if e == nil {
+			return
+		}
+		for _, w := range hooks {
+			if err := w.Send(e); err != nil {
+				log.Errorf("Failed to queue webhook: %s", err)
+			}
+		}
+	})
+	return hooks
+}
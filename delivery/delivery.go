@@ -0,0 +1,99 @@
+// Reliable delivery of spooled messages, shared by the Perceptor outbox and
+// webhooks
+
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/spool"
+)
+
+// Delays between delivery attempts, doubling from the min to the max
+var (
+	MinBackoff = time.Second
+	MaxBackoff = 5 * time.Minute
+)
+
+// Returned when the receiver responds with an error status
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("returned %d", e.Code)
+}
+
+// Returns true if retrying will not help, e.g. a 400 for a bad payload
+func (e *StatusError) Permanent() bool {
+	return e.Code >= 400 && e.Code < 500 &&
+		e.Code != http.StatusTooManyRequests &&
+		e.Code != http.StatusRequestTimeout
+}
+
+// Sends a message, returning a *StatusError if the receiver responds with
+// an error status
+type SendFunc func(ctx context.Context, data []byte) error
+
+// Told the outcome of each attempt to send a message. Retry is the delay
+// before the next attempt, 0 once the message has been delivered (err is
+// nil) or rejected for good and removed from the spool.
+type ResultFunc func(data []byte, err error, retry time.Duration)
+
+// Sends messages from the spool in the order they were pushed until the
+// context is done. Failed messages are retried with backoff, holding back
+// the messages after them so they are never delivered out of order.
+// Messages rejected with a permanent StatusError are dropped.
+func Run(ctx context.Context, s *spool.Spool, send SendFunc, result ResultFunc) {
+	backoff := MinBackoff
+	for {
+		item := s.Peek()
+		if item == nil {
+			select {
+			case <-s.Ready():
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := send(ctx, item.Data)
+		if serr, ok := err.(*StatusError); err != nil && (!ok || !serr.Permanent()) {
+			result(item.Data, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+			continue
+		}
+
+		backoff = MinBackoff
+		if err := s.Remove(item.Seq); err != nil {
+			log.Errorf("Failed to remove sent message %d: %s", item.Seq, err)
+		}
+		result(item.Data, err, 0)
+	}
+}
+
+// Blocks until every message in the spool has been sent or the context is
+// done
+func Flush(ctx context.Context, s *spool.Spool) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages not sent: %s", s.Len(), ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/spool"
+)
+
+func TestPermanent(t *testing.T) {
+	for code, want := range map[int]bool{400: true, 404: true, 408: false, 429: false, 500: false, 503: false} {
+		if got := (&StatusError{Code: code}).Permanent(); got != want {
+			t.Errorf("%d: got %t, want %t", code, got, want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	MinBackoff = time.Millisecond
+	defer func() { MinBackoff = time.Second }()
+
+	s, _ := spool.Open("", 0)
+	for _, msg := range []string{"retried", "rejected", "sent"} {
+		s.Push([]byte(msg))
+	}
+
+	var lock sync.Mutex
+	var results []string
+	failed := false
+	send := func(ctx context.Context, data []byte) error {
+		switch string(data) {
+		case "retried":
+			lock.Lock()
+			defer lock.Unlock()
+			if !failed {
+				failed = true
+				return errors.New("connection refused")
+			}
+		case "rejected":
+			return &StatusError{Code: 400}
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	result := func(data []byte, err error, retry time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case retry > 0:
+			results = append(results, "retry "+string(data))
+		case err != nil:
+			results = append(results, "drop "+string(data))
+		default:
+			results = append(results, "deliver "+string(data))
+		}
+		if string(data) == "sent" {
+			close(done)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, s, send, result)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("messages not sent")
+	}
+
+	// Messages are held back behind a failed message, never sent out of order
+	want := []string{"retry retried", "deliver retried", "drop rejected", "deliver sent"}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %v, want %v", results, want)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d messages left in the spool", s.Len())
+	}
+}
@@ -0,0 +1,46 @@
+// Event Acknowledgements
+
+package events
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const ACK_EVENT string = "ack" // Acknowledgement of an event with an id
+
+// Acknowledgement sent back to the sender of an event with an id
+type Ack struct {
+	Type  string `json:"event"`
+	Id    string `json:"id"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"` // Why the event was rejected
+	State string `json:"state,omitempty"` // Player state after the event
+}
+
+// Constructs a new Ack, a nil error acknowledges success
+func NewAck(id string, err error, state string) *Ack {
+	a := &Ack{
+		Type:  ACK_EVENT,
+		Id:    id,
+		Ok:    err == nil,
+		State: state,
+	}
+	if err != nil {
+		a.Error = fmt.Sprintf("rejected: %s", err)
+	}
+	return a
+}
+
+// Sends acknowledgements back to event senders
+type Acker interface {
+	Ack(a *Ack) error
+}
+
+// Sends the ack, logging failures
+func sendAck(acker Acker, a *Ack) {
+	if err := acker.Ack(a); err != nil {
+		log.Errorf("Failed to send ack %s: %s", a.Id, err)
+	}
+}
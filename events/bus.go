@@ -0,0 +1,146 @@
+// In Process Event Bus
+
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// What the bus does when a subscribers buffer is full
+type Policy int
+
+const (
+	DROP_POLICY  Policy = iota // Drop the event for that subscriber
+	BLOCK_POLICY               // Block the publisher until there is room
+)
+
+// A subscription to one or more event types on the bus
+type Subscription struct {
+	name    string
+	types   map[string]bool // Event types to receive, all types if empty
+	policy  Policy
+	c       chan Event
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64 // Events dropped because the buffer was full
+	bus     *Bus
+}
+
+// Returns the channel events are delivered on, closed once unsubscribed
+func (s *Subscription) Events() <-chan Event {
+	return s.c
+}
+
+// Returns the number of events dropped for this subscriber
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Removes the subscription from the bus, unblocking any publisher waiting
+// on it
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.bus.remove(s)
+		close(s.c)
+	})
+}
+
+// Returns true if the subscription wants the event type
+func (s *Subscription) wants(t string) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// Delivers the event according to the subscription policy, returning false
+// if it was dropped
+func (s *Subscription) deliver(e Event) bool {
+	if s.policy == BLOCK_POLICY {
+		select {
+		case s.c <- e:
+		case <-s.done:
+		}
+		return true
+	}
+	select {
+	case s.c <- e:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		log.Warnf("Subscriber %s full, dropped %s event", s.name, e.Header().Type)
+		return false
+	}
+}
+
+// Publishes events to any number of subscribers
+type Bus struct {
+	lock        sync.RWMutex
+	subscribers []*Subscription
+}
+
+// Subscribes to the given event types, or every event if none are given.
+// Each subscriber has its own buffer of the given size, the policy decides
+// what happens when it is full.
+func (b *Bus) Subscribe(name string, size int, policy Policy, types ...string) *Subscription {
+	s := &Subscription{
+		name:   name,
+		types:  make(map[string]bool),
+		policy: policy,
+		c:      make(chan Event, size),
+		done:   make(chan struct{}),
+		bus:    b,
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers = append(b.subscribers, s)
+
+	return s
+}
+
+// Publishes an event to all subscribers of its type, returning the number
+// of subscribers it was published to
+func (b *Bus) Publish(e Event) int {
+	delivered, dropped := b.publish(e)
+	return delivered + dropped
+}
+
+// Publishes an event, returning the number of subscribers it was delivered
+// to and the number that dropped it
+func (b *Bus) publish(e Event) (delivered int, dropped int) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, s := range b.subscribers {
+		if !s.wants(e.Header().Type) {
+			continue
+		}
+		if s.deliver(e) {
+			delivered++
+		} else {
+			dropped++
+		}
+	}
+	return delivered, dropped
+}
+
+// Removes a subscription
+func (b *Bus) remove(s *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, sub := range b.subscribers {
+		if sub == s {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Constructs a new Bus
+func NewBus() *Bus {
+	return &Bus{}
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func volumeEvent(vol int) Event {
+	return &VolumeEvent{Base: Base{Type: VOLUME_EVENT, Timestamp: time.Now()}, Volume: vol}
+}
+
+func TestDropPolicy(t *testing.T) {
+	bus := NewBus()
+	s := bus.Subscribe("test", 1, DROP_POLICY, VOLUME_EVENT)
+
+	if delivered, dropped := bus.publish(volumeEvent(1)); delivered != 1 || dropped != 0 {
+		t.Errorf("first event: delivered %d, dropped %d", delivered, dropped)
+	}
+	if delivered, dropped := bus.publish(volumeEvent(2)); delivered != 0 || dropped != 1 {
+		t.Errorf("event over the buffer: delivered %d, dropped %d", delivered, dropped)
+	}
+	// Dropped subscribers still count as published to
+	if n := bus.Publish(volumeEvent(3)); n != 1 {
+		t.Errorf("published to %d subscribers", n)
+	}
+	if s.Dropped() != 2 {
+		t.Errorf("dropped %d events, want 2", s.Dropped())
+	}
+	if e := <-s.Events(); e.(*VolumeEvent).Volume != 1 {
+		t.Errorf("got %+v, want the first event", e)
+	}
+}
+
+func TestBlockPolicy(t *testing.T) {
+	bus := NewBus()
+	s := bus.Subscribe("test", 1, BLOCK_POLICY, VOLUME_EVENT)
+	bus.Publish(volumeEvent(1))
+
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(volumeEvent(2))
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publisher did not block on the full subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for _, want := range []int{1, 2} {
+		if e := <-s.Events(); e.(*VolumeEvent).Volume != want {
+			t.Errorf("got %+v, want volume %d", e, want)
+		}
+	}
+	<-published
+	if s.Dropped() != 0 {
+		t.Errorf("dropped %d events", s.Dropped())
+	}
+}
+
+func TestCloseUnblocksPublisher(t *testing.T) {
+	bus := NewBus()
+	s := bus.Subscribe("test", 1, BLOCK_POLICY, VOLUME_EVENT)
+	bus.Publish(volumeEvent(1))
+
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(volumeEvent(2))
+		close(published)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still blocked after close")
+	}
+
+	// Closed subscriptions no longer receive events
+	if n := bus.Publish(volumeEvent(3)); n != 0 {
+		t.Errorf("published to %d subscribers after close", n)
+	}
+	s.Close() // Safe to close twice
+}
+
+func TestSubscribedTypes(t *testing.T) {
+	bus := NewBus()
+	volume := bus.Subscribe("volume", 1, DROP_POLICY, VOLUME_EVENT)
+	all := bus.Subscribe("all", 2, DROP_POLICY)
+
+	bus.Publish(volumeEvent(1))
+	bus.Publish(&StopEvent{Base: Base{Type: STOP_EVENT}})
+	if len(volume.Events()) != 1 || len(all.Events()) != 2 {
+		t.Errorf("volume got %d events, all got %d", len(volume.Events()), len(all.Events()))
+	}
+}
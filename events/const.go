@@ -4,8 +4,19 @@ package events
 
 // Event names
 const (
-	ADD_EVENT    string = "add"    // Add track event
-	RESUME_EVENT string = "resume" // Resume paused track
-	PAUSE_EVENT  string = "pause"  // Pause a playing track
-	STOP_EVENT   string = "stop"   // Stop the currently playing track (aka skip)
+	ADD_EVENT      string = "add"      // Add track event
+	PLAY_EVENT     string = "play"     // Track started playing
+	END_EVENT      string = "end"      // Track finished playing
+	RESUME_EVENT   string = "resume"   // Resume paused track
+	PAUSE_EVENT    string = "pause"    // Pause a playing track
+	STOP_EVENT     string = "stop"     // Stop the currently playing track (aka skip)
+	VOLUME_EVENT   string = "volume"   // Change the playback volume
+	LOCK_EVENT     string = "lock"     // Stop or start accepting added tracks
+	FALLBACK_EVENT string = "fallback" // Set or clear the fallback playlist
+)
+
+// Internal event names, these are never decoded from messages
+const (
+	CONNECTION_EVENT string = "connection" // Event service connection changed
+	ERROR_EVENT      string = "error"      // Track failed to play, only sent to other services
 )
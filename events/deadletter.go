@@ -0,0 +1,115 @@
+// Dead Letters for rejected messages
+
+package events
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Reasons a message is rejected
+const (
+	MALFORMED_REJECTION string = "malformed" // Not an event, e.g invalid JSON or no type
+	UNKNOWN_REJECTION   string = "unknown"   // Event type is not supported
+	INVALID_REJECTION   string = "invalid"   // Event failed validation
+	UNHANDLED_REJECTION string = "unhandled" // Nothing subscribed to the event
+	DROPPED_REJECTION   string = "dropped"   // Every subscriber was too busy to take the event
+	LIMITED_REJECTION   string = "limited"   // Event was debounced or rate limited
+	FILTERED_REJECTION  string = "filtered"  // Event was rejected by a filter
+	FAILED_REJECTION    string = "failed"    // Handler failed to act on the event
+	UNSIGNED_REJECTION  string = "unsigned"  // Signature missing, invalid, stale or replayed
+)
+
+const DEAD_LETTER_ENTRY string = "rejected" // Kind of entry dead letters are recorded as
+
+// Count of rejected messages by reason
+var rejectedEvents = expvar.NewMap("rejected_events")
+
+// Number of recent rejections kept in memory
+var recentRejections = 50
+
+// A rejected message
+type Rejection struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Type    string    `json:"type,omitempty"`
+	Error   string    `json:"error"`
+	Message string    `json:"message"`
+}
+
+// Records rejections, satisfied by journal.Journal
+type Recorder interface {
+	Record(kind string, name string, data interface{})
+}
+
+// Reports rejections back to the event sender
+type Reporter interface {
+	Rejected(r *Rejection)
+}
+
+// Collects rejected messages, counting them by reason and recording them to
+// a sink. In strict mode unsupported event types are reported back to the
+// sender. A nil DeadLetters only logs rejections.
+type DeadLetters struct {
+	lock     sync.Mutex
+	recent   []*Rejection
+	sink     Recorder
+	reporter Reporter
+	strict   bool
+}
+
+// Rejects a message for the reason
+func (d *DeadLetters) Reject(msg []byte, reason string, eventType string, err error) {
+	log.Errorf("Rejected %s (%s): %s", msg, reason, err)
+	if d == nil {
+		return
+	}
+
+	r := &Rejection{
+		Time:    time.Now().UTC(),
+		Reason:  reason,
+		Type:    eventType,
+		Error:   err.Error(),
+		Message: string(msg),
+	}
+	rejectedEvents.Add(reason, 1)
+
+	d.lock.Lock()
+	d.recent = append(d.recent, r)
+	if len(d.recent) > recentRejections {
+		d.recent = d.recent[len(d.recent)-recentRejections:]
+	}
+	d.lock.Unlock()
+
+	if d.sink != nil {
+		d.sink.Record(DEAD_LETTER_ENTRY, reason, r)
+	}
+	if d.strict && d.reporter != nil && reason == UNKNOWN_REJECTION {
+		go d.reporter.Rejected(r)
+	}
+}
+
+// Returns the most recent rejections, oldest first
+func (d *DeadLetters) Recent() []*Rejection {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	recent := make([]*Rejection, len(d.recent))
+	copy(recent, d.recent)
+	return recent
+}
+
+// Constructs new DeadLetters recording to the sink, which may be nil. When
+// strict unsupported event types are reported with the reporter.
+func NewDeadLetters(sink Recorder, reporter Reporter, strict bool) *DeadLetters {
+	return &DeadLetters{
+		sink:     sink,
+		reporter: reporter,
+		strict:   strict,
+	}
+}
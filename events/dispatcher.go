@@ -0,0 +1,50 @@
+// Event Dispatcher
+
+package events
+
+import (
+	"errors"
+	"sync"
+)
+
+// Dispatches events to the handler registered for their type, events of
+// types with no handler are published on the bus
+type Dispatcher struct {
+	lock     sync.RWMutex
+	handlers map[string]HandlerFunc
+	bus      *Bus
+}
+
+// Registers the handler for an event type, replacing any existing handler
+func (d *Dispatcher) Handle(eventType string, h HandlerFunc) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers[eventType] = h
+}
+
+// Dispatches the event, rejecting it if nothing handles it or every
+// subscriber was too busy to take it
+func (d *Dispatcher) Dispatch(e Event) error {
+	d.lock.RLock()
+	h, ok := d.handlers[e.Header().Type]
+	d.lock.RUnlock()
+	if ok {
+		return h(e)
+	}
+	delivered, dropped := d.bus.publish(e)
+	switch {
+	case delivered == 0 && dropped > 0:
+		return &RejectError{Reason: DROPPED_REJECTION, Err: errors.New("subscribers busy")}
+	case delivered == 0:
+		return &RejectError{Reason: UNHANDLED_REJECTION, Err: errors.New("no subscribers")}
+	}
+	return nil
+}
+
+// Constructs a new Dispatcher publishing unhandled event types on the bus
+func NewDispatcher(bus *Bus) *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[string]HandlerFunc),
+		bus:      bus,
+	}
+}
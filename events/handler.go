@@ -3,60 +3,98 @@
 package events
 
 import (
-	"encoding/json"
+	"context"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-type event struct {
-	Type string `json:"event"`
-}
-
 type Handler struct {
-	in  chan []byte // channel to read messages from
-	out *Channels   // channels to pass events too
+	in          chan []byte  // channel to read messages from
+	dispatcher  *Dispatcher  // dispatches events to their handlers
+	acker       Acker        // sends acknowledgements for events with an id
+	deadLetters *DeadLetters // collects rejected messages
+	lock        sync.Mutex   // guards middleware
+	middleware  []Middleware // wraps the dispatcher, outermost first
 }
 
-// Reads messages of the event channel and deligates to other channeks
-// to  be actioned upon
-func (h *Handler) Run() {
+// Reads messages of the event channel, decodes them and passes the typed
+// events through the middleware to the dispatcher to be actioned upon, until
+// the context is done
+func (h *Handler) Run(ctx context.Context) {
 	for {
-		msg := <-h.in
-		// Unmarshal the message
-		e := &event{}
-		if err := json.Unmarshal(msg, e); err != nil {
-			log.Errorf("Error Unmarshaling %s: %s", msg, err)
+		var msg []byte
+		select {
+		case msg = <-h.in:
+		case <-ctx.Done():
+			return
 		}
-		// Switch the event type
-		switch e.Type {
-		case ADD_EVENT:
-			// pass to volume channel
-			log.Debugf("Place on Add Channel: %s", msg)
-			h.out.Add <- msg
-		case PAUSE_EVENT:
-			// pass to pause channel
-			log.Debugf("Place on Pause Channel: %s", msg)
-			h.out.Pause <- true
-		case RESUME_EVENT:
-			// pass to resume channel
-			log.Debugf("Place on Resume Channel: %s", msg)
-			h.out.Pause <- false
-		case STOP_EVENT:
-			// pass to stop channel
-			log.Debugf("Place on Skip Channel: %s", msg)
-			h.out.Skip <- true
+		// Decode the message, rejecting malformed events
+		e, err := Decode(msg)
+		if err != nil {
+			derr := err.(*DecodeError)
+			h.deadLetters.Reject(msg, derr.Reason, derr.Type, err)
+			if derr.Id != "" && h.acker != nil {
+				sendAck(h.acker, NewAck(derr.Id, err, ""))
+			}
+			continue
+		}
+		e.Header().acker = h.acker
+		log.Debugf("Dispatch %s Event: %s", e.Header().Type, msg)
+		if err := h.handler()(e); err != nil {
+			reason := FAILED_REJECTION
+			if rerr, ok := err.(*RejectError); ok {
+				reason = rerr.Reason
+			}
+			h.deadLetters.Reject(msg, reason, e.Header().Type, err)
+			e.Header().Ack(err, "")
 		}
 	}
 }
 
+// Returns the dispatcher wrapped in the middleware
+func (h *Handler) handler() HandlerFunc {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return chain(h.dispatcher.Dispatch, h.middleware...)
+}
+
+// Adds middleware, events pass through middleware in the order it was added
+func (h *Handler) Use(m ...Middleware) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.middleware = append(h.middleware, m...)
+}
+
+// Registers the handler for an event type in place of publishing it on the
+// bus, see Register to add new event types
+func (h *Handler) Handle(eventType string, f HandlerFunc) {
+	h.dispatcher.Handle(eventType, f)
+}
+
 func (h *Handler) ReceiveChannel() chan []byte {
 	return h.in
 }
 
-// Constructs a new Handler
-func NewHandler(out *Channels) *Handler {
-	return &Handler{
-		in:  make(chan []byte),
-		out: out,
+// Sets where acknowledgements for events with an id are sent
+func (h *Handler) SetAcker(a Acker) {
+	h.acker = a
+}
+
+// Sets where rejected messages are sent
+func (h *Handler) SetDeadLetters(d *DeadLetters) {
+	h.deadLetters = d
+}
+
+// Constructs a new Handler. Play and end events are accepted but ignored
+// until a handler is registered for them, Perceptor sends them when other
+// clients play tracks.
+func NewHandler(bus *Bus) *Handler {
+	h := &Handler{
+		in:         make(chan []byte),
+		dispatcher: NewDispatcher(bus),
 	}
+	h.Handle(PLAY_EVENT, Ignore)
+	h.Handle(END_EVENT, Ignore)
+	return h
 }
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// Records acknowledgements
+type fakeAcker struct {
+	lock sync.Mutex
+	acks map[string]*Ack
+}
+
+func (a *fakeAcker) Ack(ack *Ack) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.acks[ack.Id] = ack
+	return nil
+}
+
+func (a *fakeAcker) get(id string) *Ack {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.acks[id]
+}
+
+func TestDroppedEventsAcked(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe("full", 1, DROP_POLICY, ADD_EVENT)
+	acker := &fakeAcker{acks: make(map[string]*Ack)}
+	deadLetters := NewDeadLetters(nil, nil, false)
+	h := NewHandler(bus)
+	h.SetAcker(acker)
+	h.SetDeadLetters(deadLetters)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	h.ReceiveChannel() <- []byte(`{"event": "add", "id": "1", "uri": "spotify:track:a"}`)
+	h.ReceiveChannel() <- []byte(`{"event": "add", "id": "2", "uri": "spotify:track:b"}`)
+	h.ReceiveChannel() <- []byte(`{"event": "volume", "volume": 10}`) // Waits for the add to be handled
+
+	if e := <-sub.Events(); e.Header().Id != "1" {
+		t.Errorf("got event %s, want 1", e.Header().Id)
+	}
+	ack := acker.get("2")
+	if ack == nil || ack.Ok {
+		t.Fatalf("dropped event acked with %+v", ack)
+	}
+	if acker.get("1") != nil {
+		t.Error("delivered event acked by the handler")
+	}
+	recent := deadLetters.Recent()
+	if len(recent) == 0 || recent[0].Reason != DROPPED_REJECTION {
+		t.Errorf("got dead letters %+v", recent)
+	}
+}
+
+func TestPlayAndEndIgnored(t *testing.T) {
+	bus := NewBus()
+	volume := bus.Subscribe("volume", 1, BLOCK_POLICY, VOLUME_EVENT)
+	deadLetters := NewDeadLetters(nil, nil, false)
+	h := NewHandler(bus)
+	h.SetDeadLetters(deadLetters)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	h.ReceiveChannel() <- []byte(`{"event": "play", "uri": "spotify:track:a"}`)
+	h.ReceiveChannel() <- []byte(`{"event": "end", "uri": "spotify:track:a"}`)
+	h.ReceiveChannel() <- []byte(`{"event": "volume", "volume": 10}`)
+	<-volume.Events()
+
+	if recent := deadLetters.Recent(); len(recent) != 0 {
+		t.Errorf("got dead letters %+v", recent)
+	}
+}
@@ -0,0 +1,75 @@
+// Debouncing and Rate Limiting of Events
+
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reasons an event is limited
+var (
+	ErrDebounced   = errors.New("debounced, collapsed into a previous event")
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// Limits applied to one event type, zero values disable the limit
+type Limit struct {
+	Debounce time.Duration // Events within this long of the last accepted event are collapsed into it
+	Rate     int           // Events accepted per interval
+	Interval time.Duration
+}
+
+// Applies limits per event type
+type Limiter struct {
+	lock     sync.Mutex
+	limits   map[string]Limit
+	last     map[string]time.Time   // Time the last event of each type and key was accepted
+	accepted map[string][]time.Time // Times events were accepted within the rate interval
+}
+
+// Returns nil if the event type is allowed now, ErrDebounced or
+// ErrRateLimited if not. Allowed events count towards the limits. Events are
+// only debounced against earlier events with the same key, e.g. skips of
+// the same track.
+func (l *Limiter) Allow(eventType string, key string, now time.Time) error {
+	limit, ok := l.limits[eventType]
+	if !ok {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	debounceKey := eventType + "/" + key
+	if limit.Debounce > 0 && now.Sub(l.last[debounceKey]) < limit.Debounce {
+		return ErrDebounced
+	}
+
+	if limit.Rate > 0 && limit.Interval > 0 {
+		// Forget events that have left the interval
+		accepted := l.accepted[eventType]
+		for len(accepted) > 0 && now.Sub(accepted[0]) >= limit.Interval {
+			accepted = accepted[1:]
+		}
+		if len(accepted) >= limit.Rate {
+			l.accepted[eventType] = accepted
+			return ErrRateLimited
+		}
+		l.accepted[eventType] = append(accepted, now)
+	}
+
+	l.last[debounceKey] = now
+
+	return nil
+}
+
+// Constructs a new Limiter with limits keyed by event type
+func NewLimiter(limits map[string]Limit) *Limiter {
+	return &Limiter{
+		limits:   limits,
+		last:     make(map[string]time.Time),
+		accepted: make(map[string][]time.Time),
+	}
+}
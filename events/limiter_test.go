@@ -0,0 +1,42 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	l := NewLimiter(map[string]Limit{STOP_EVENT: {Debounce: 2 * time.Second}})
+	now := time.Now()
+
+	if err := l.Allow(STOP_EVENT, "a", now); err != nil {
+		t.Fatalf("first skip of a: %s", err)
+	}
+	if err := l.Allow(STOP_EVENT, "a", now.Add(time.Second)); err != ErrDebounced {
+		t.Errorf("second skip of a: got %v, want %v", err, ErrDebounced)
+	}
+	// A late skip of an earlier track does not hold back a skip of the next
+	if err := l.Allow(STOP_EVENT, "b", now.Add(time.Second)); err != nil {
+		t.Errorf("skip of b: %s", err)
+	}
+	if err := l.Allow(STOP_EVENT, "a", now.Add(3*time.Second)); err != nil {
+		t.Errorf("skip of a after the debounce: %s", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	l := NewLimiter(map[string]Limit{VOLUME_EVENT: {Rate: 2, Interval: time.Second}})
+	now := time.Now()
+
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if err := l.Allow(VOLUME_EVENT, "", now); err != want {
+			t.Errorf("event %d: got %v, want %v", i, err, want)
+		}
+	}
+	if err := l.Allow(VOLUME_EVENT, "", now.Add(time.Second)); err != nil {
+		t.Errorf("event after the interval: %s", err)
+	}
+	if err := l.Allow(ADD_EVENT, "", now); err != nil {
+		t.Errorf("unlimited type: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Event Middleware
+
+package events
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Acts on a decoded event, returning an error if the event was rejected
+type HandlerFunc func(e Event) error
+
+// Wraps a HandlerFunc with behaviour common to all events, e.g logging. A
+// middleware may act before and after calling next or reject the event by
+// not calling it.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Returned by handlers and middleware to reject an event for a reason
+type RejectError struct {
+	Reason string // Why the event was rejected, one of the *_REJECTION constants
+	Err    error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+// Accepts the event without acting on it
+func Ignore(e Event) error {
+	log.Debugf("Ignored %s Event", e.Header().Type)
+	return nil
+}
+
+// Wraps the handler in the middleware, the first middleware is outermost
+func chain(h HandlerFunc, middleware ...Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Logs each event and how long it took to handle
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(e Event) error {
+			start := time.Now()
+			log.Debugf("Handle %s Event from %s", e.Header().Type, e.Header().User)
+			err := next(e)
+			log.Debugf("Handled %s Event in %s", e.Header().Type, time.Since(start))
+			return err
+		}
+	}
+}
+
+// Count of handled events by type
+var handledEvents = expvar.NewMap("handled_events")
+
+// Counts events by type, published with expvar as handled_events
+func Metrics() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(e Event) error {
+			err := next(e)
+			if err == nil {
+				handledEvents.Add(e.Header().Type, 1)
+			}
+			return err
+		}
+	}
+}
+
+// Rejects events that are over the limits of their type, skips are only
+// debounced against skips of the same track so a stale skip of a track that
+// has already ended cannot hold back a skip of the next
+func Throttle(l *Limiter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(e Event) error {
+			if err := l.Allow(e.Header().Type, limitKey(e), time.Now()); err != nil {
+				return &RejectError{Reason: LIMITED_REJECTION, Err: err}
+			}
+			return next(e)
+		}
+	}
+}
+
+// Key events are debounced by within their type
+func limitKey(e Event) string {
+	if stop, ok := e.(*StopEvent); ok {
+		return stop.Track
+	}
+	return ""
+}
+
+// Rejects events the function returns an error for, e.g. to only accept
+// events from some users
+func Filter(f func(e Event) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(e Event) error {
+			if err := f(e); err != nil {
+				return &RejectError{
+					Reason: FILTERED_REJECTION,
+					Err:    fmt.Errorf("filtered: %s", err),
+				}
+			}
+			return next(e)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Typed Event Payloads
+
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Implemented by every typed event
+type Event interface {
+	Header() *Base   // Fields common to all events
+	Validate() error // Checks the decoded payload is usable
+}
+
+// Fields common to every event
+type Base struct {
+	Type      string    `json:"event"`
+	Id        string    `json:"id,omitempty"` // Set by senders wanting an acknowledgement
+	User      string    `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	acker     Acker     // Where to send the acknowledgement, set by the handler
+	acked     bool
+}
+
+func (b *Base) Header() *Base {
+	return b
+}
+
+// Acknowledges the event back to its sender with the result of acting on it
+// and the resulting player state. Does nothing if the sender did not ask for
+// an acknowledgement or it has already been sent.
+func (b *Base) Ack(err error, state string) {
+	if b.Id == "" || b.acker == nil || b.acked {
+		return
+	}
+	b.acked = true
+	sendAck(b.acker, NewAck(b.Id, err, state))
+}
+
+func (b *Base) Validate() error {
+	return nil
+}
+
+// A track has been added to the playlist
+type AddEvent struct {
+	Base
+	Track string `json:"track,omitempty"` // Track uuid
+	Uri   string `json:"uri"`
+}
+
+func (e *AddEvent) Validate() error {
+	if e.Uri == "" {
+		return errors.New("missing uri")
+	}
+	return nil
+}
+
+// A track has started playing
+type PlayEvent struct {
+	Base
+	Track    string `json:"track,omitempty"` // Track uuid
+	Uri      string `json:"uri"`
+	Position int64  `json:"position"` // Position playback started from in ms
+}
+
+func (e *PlayEvent) Validate() error {
+	if e.Uri == "" {
+		return errors.New("missing uri")
+	}
+	if e.Position < 0 {
+		return fmt.Errorf("invalid position: %d", e.Position)
+	}
+	return nil
+}
+
+// A track has finished playing
+type EndEvent struct {
+	Base
+	Track string `json:"track,omitempty"` // Track uuid
+	Uri   string `json:"uri"`
+}
+
+func (e *EndEvent) Validate() error {
+	if e.Uri == "" {
+		return errors.New("missing uri")
+	}
+	return nil
+}
+
+// A track failed to play
+type ErrorEvent struct {
+	Base
+	Track   string `json:"track,omitempty"` // Track uuid
+	Uri     string `json:"uri"`
+	Stage   string `json:"stage"` // Stage the track failed at, e.g. load
+	Message string `json:"message"`
+}
+
+func (e *ErrorEvent) Validate() error {
+	if e.Uri == "" {
+		return errors.New("missing uri")
+	}
+	return nil
+}
+
+// Pause the playing track. A held pause also pauses tracks that start
+// before the next resume, and is accepted when nothing is playing.
+type PauseEvent struct {
+	Base
+	Position int64 `json:"position,omitempty"` // Position paused at in ms
+	Hold     bool  `json:"hold,omitempty"`
+}
+
+func (e *PauseEvent) Validate() error {
+	if e.Position < 0 {
+		return fmt.Errorf("invalid position: %d", e.Position)
+	}
+	return nil
+}
+
+// Resume the paused track
+type ResumeEvent struct {
+	Base
+}
+
+// Stop the currently playing track (aka skip)
+type StopEvent struct {
+	Base
+	Track string `json:"track,omitempty"` // Uuid of the track to stop
+}
+
+// Change the playback volume
+type VolumeEvent struct {
+	Base
+	Volume int `json:"volume"` // Volume percentage, 0 - 100
+}
+
+func (e *VolumeEvent) Validate() error {
+	if e.Volume < 0 || e.Volume > 100 {
+		return fmt.Errorf("invalid volume: %d", e.Volume)
+	}
+	return nil
+}
+
+// Stop accepting added tracks, or start again once unlocked
+type LockEvent struct {
+	Base
+	Locked bool `json:"locked"`
+}
+
+// Set the playlist played when there is nothing else to play, an empty
+// playlist clears it
+type FallbackEvent struct {
+	Base
+	Playlist []string `json:"playlist"` // Track uris
+}
+
+func (e *FallbackEvent) Validate() error {
+	for _, uri := range e.Playlist {
+		if uri == "" {
+			return errors.New("empty uri in playlist")
+		}
+	}
+	return nil
+}
+
+// The connection to an event service has changed
+type ConnectionEvent struct {
+	Base
+	Connected bool   `json:"connected"`
+	Addr      string `json:"addr"`
+	Error     string `json:"error,omitempty"` // Why the connection was lost or could not be made
+}
+
+// Constructs a new connection event
+func NewConnectionEvent(addr string, connected bool) *ConnectionEvent {
+	return &ConnectionEvent{
+		Base: Base{
+			Type:      CONNECTION_EVENT,
+			Timestamp: time.Now().UTC(),
+		},
+		Connected: connected,
+		Addr:      addr,
+	}
+}
+
+// Guards eventTypes
+var eventTypesLock sync.RWMutex
+
+// Constructors for the typed event of each event name
+var eventTypes = map[string]func() Event{
+	ADD_EVENT:      func() Event { return &AddEvent{} },
+	PLAY_EVENT:     func() Event { return &PlayEvent{} },
+	END_EVENT:      func() Event { return &EndEvent{} },
+	PAUSE_EVENT:    func() Event { return &PauseEvent{} },
+	RESUME_EVENT:   func() Event { return &ResumeEvent{} },
+	STOP_EVENT:     func() Event { return &StopEvent{} },
+	VOLUME_EVENT:   func() Event { return &VolumeEvent{} },
+	LOCK_EVENT:     func() Event { return &LockEvent{} },
+	FALLBACK_EVENT: func() Event { return &FallbackEvent{} },
+}
+
+// Registers a new event type, so messages of that type are decoded by the
+// handler rather than rejected as unknown. The constructor returns an empty
+// event for the message to be decoded into.
+func Register(eventType string, newEvent func() Event) {
+	eventTypesLock.Lock()
+	defer eventTypesLock.Unlock()
+	eventTypes[eventType] = newEvent
+}
+
+// Returned when a message does not decode to a valid event
+type DecodeError struct {
+	Reason string // Why the message was rejected, one of the *_REJECTION constants
+	Type   string // Event type, empty if it could not be read
+	Id     string // Event id, empty if it could not be read
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("malformed event: %s", e.Err)
+	}
+	return fmt.Sprintf("malformed %s event: %s", e.Type, e.Err)
+}
+
+// Decodes a raw message into its typed event, messages that are malformed,
+// of an unknown type or fail validation are rejected with a DecodeError
+func Decode(msg []byte) (Event, error) {
+	b := &Base{}
+	if err := json.Unmarshal(msg, b); err != nil {
+		return nil, &DecodeError{Reason: MALFORMED_REJECTION, Err: err}
+	}
+	if b.Type == "" {
+		return nil, &DecodeError{Reason: MALFORMED_REJECTION, Id: b.Id, Err: errors.New("missing event type")}
+	}
+
+	eventTypesLock.RLock()
+	newEvent, ok := eventTypes[b.Type]
+	eventTypesLock.RUnlock()
+	if !ok {
+		return nil, &DecodeError{Reason: UNKNOWN_REJECTION, Type: b.Type, Id: b.Id, Err: errors.New("unknown event type")}
+	}
+
+	e := newEvent()
+	if err := json.Unmarshal(msg, e); err != nil {
+		return nil, &DecodeError{Reason: MALFORMED_REJECTION, Type: b.Type, Id: b.Id, Err: err}
+	}
+	if err := e.Validate(); err != nil {
+		return nil, &DecodeError{Reason: INVALID_REJECTION, Type: b.Type, Id: b.Id, Err: err}
+	}
+
+	// Events without a timestamp are stamped with the time they arrived
+	if e.Header().Timestamp.IsZero() {
+		e.Header().Timestamp = time.Now().UTC()
+	}
+
+	return e, nil
+}
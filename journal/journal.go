@@ -0,0 +1,175 @@
+// Append only journal of events, written as rotated JSON lines
+
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Kinds of journal entry
+const (
+	INBOUND_ENTRY  string = "inbound"  // Message received from an event service
+	OUTBOUND_ENTRY string = "outbound" // Event sent to Perceptor
+	STATE_ENTRY    string = "state"    // Player state change
+)
+
+// A single line of the journal
+type Entry struct {
+	Time time.Time       `json:"time"`
+	Kind string          `json:"kind"`
+	Name string          `json:"name"` // What the entry is, e.g the source or event name
+	Data json.RawMessage `json:"data"`
+}
+
+// Writes entries to a file, rotating it once it reaches the max size. A nil
+// Journal discards everything recorded to it.
+type Journal struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64 // Size in bytes to rotate at, 0 never rotates
+	maxFiles int   // Number of rotated files to keep
+	file     *os.File
+	size     int64
+}
+
+// Records an entry. Data that is already JSON, as []byte, is written as is,
+// anything else is marshalled. Failures are logged, never returned, so the
+// journal can not interfere with playback.
+func (j *Journal) Record(kind string, name string, data interface{}) {
+	if j == nil {
+		return
+	}
+
+	raw, ok := data.([]byte)
+	if !ok || !json.Valid(raw) {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			log.Errorf("Journal: Failed to marshal %s %s: %s", kind, name, err)
+			return
+		}
+	}
+
+	line, err := json.Marshal(&Entry{
+		Time: time.Now().UTC(),
+		Kind: kind,
+		Name: name,
+		Data: raw,
+	})
+	if err != nil {
+		log.Errorf("Journal: Failed to marshal entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.maxSize > 0 && j.size+int64(len(line)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			log.Errorf("Journal: Failed to rotate %s: %s", j.path, err)
+		}
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		log.Errorf("Journal: Failed to write %s: %s", j.path, err)
+	}
+}
+
+// Closes the journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
+
+// Moves the current file to path.1, shifting older files up and removing
+// the oldest, then opens a new file. With no rotated files kept the current
+// file is removed.
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", j.path, j.maxFiles))
+	for i := j.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", j.path, i), fmt.Sprintf("%s.%d", j.path, i+1))
+	}
+	if j.maxFiles > 0 {
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(j.path); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+// Opens the journal file for appending
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.size = info.Size()
+	return nil
+}
+
+// Opens the journal at path, appending to it if it already exists
+func Open(path string, maxSize int64, maxFiles int) (*Journal, error) {
+	j := &Journal{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Reads entries from a journal
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// Returns the next entry, or io.EOF once there are no more
+func (r *Reader) Next() (*Entry, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	r.line++
+	e := &Entry{}
+	if err := json.Unmarshal(r.scanner.Bytes(), e); err != nil {
+		return nil, fmt.Errorf("line %d: %s", r.line, err)
+	}
+	return e, nil
+}
+
+// Constructs a new Reader
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &Reader{
+		scanner: scanner,
+	}
+}
@@ -0,0 +1,36 @@
+package journal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	for _, maxFiles := range []int{0, 1, 2} {
+		path := filepath.Join(t.TempDir(), "journal")
+		j, err := Open(path, 200, maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			j.Record(STATE_ENTRY, "play", map[string]int{"i": i})
+		}
+		j.Close()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%d files: journal grew to %d bytes", maxFiles, info.Size())
+		}
+		for i := 1; i <= maxFiles+1; i++ {
+			_, err := os.Stat(fmt.Sprintf("%s.%d", path, i))
+			if kept := i <= maxFiles; kept != (err == nil) {
+				t.Errorf("%d files: rotated file %d kept %v", maxFiles, i, err == nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// MQTT transport for control commands and now playing state
+
+package mqtt
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+	"github.com/thisissoon/FM-SoundWave/tlsutil"
+)
+
+// Topics commands are received on and state is published to
+type Topics struct {
+	Pause      string // Pause the playing track
+	Resume     string // Resume the paused track
+	Skip       string // Skip the current track
+	Volume     string // Set the volume, payload is a percentage
+	NowPlaying string // Retained now playing state
+	Status     string // Retained online / offline status
+}
+
+// MQTT client configuration
+type Config struct {
+	Broker   string // Broker URL, e.g tcp://localhost:1883
+	ClientId string
+	Username string
+	Password string
+	QoS      byte
+	Topics   Topics
+	TLS      tlsutil.Config // Ignored unless the broker uses ssl://
+}
+
+// Now playing state published to the now playing topic
+type nowPlaying struct {
+	State     string    `json:"state"`
+	Track     string    `json:"track,omitempty"`
+	Uri       string    `json:"uri,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Receives commands and publishes now playing state over MQTT
+type MQTT struct {
+	config Config
+	client paho.Client
+	out    chan []byte // channel to send commands too as events
+	bus    *events.Bus // Bus to publish connection events to
+}
+
+// Connects to the broker, retrying until connected. Once connected the
+// client reconnects and resubscribes to the command topics on its own.
+func (m *MQTT) Connect() {
+	log.Infof("Connecting to MQTT Broker: %s", m.config.Broker)
+	for {
+		token := m.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		log.Errorf("MQTT Connect Error: %s", token.Error())
+		time.Sleep(time.Second)
+	}
+}
+
+// Subscribes to the command topics, called on every (re)connection
+func (m *MQTT) onConnect(c paho.Client) {
+	log.Infof("Connected to MQTT Broker: %s", m.config.Broker)
+	commands := map[string]func([]byte) (events.Event, error){
+		m.config.Topics.Pause:  m.pause,
+		m.config.Topics.Resume: m.resume,
+		m.config.Topics.Skip:   m.skip,
+		m.config.Topics.Volume: m.volume,
+	}
+	for topic, command := range commands {
+		if topic == "" {
+			continue
+		}
+		command := command
+		token := c.Subscribe(topic, m.config.QoS, func(c paho.Client, msg paho.Message) {
+			m.handle(msg, command)
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Errorf("MQTT Subscribe Error %s: %s", topic, token.Error())
+		}
+	}
+	m.publish(m.config.Topics.Status, []byte("online"))
+	m.bus.Publish(events.NewConnectionEvent(m.config.Broker, true))
+}
+
+// Called when the connection to the broker is lost
+func (m *MQTT) onConnectionLost(c paho.Client, err error) {
+	log.Errorf("MQTT Connection Lost: %s", err)
+	m.bus.Publish(events.NewConnectionEvent(m.config.Broker, false))
+}
+
+// Converts a command message to an event and passes it to the event handler
+func (m *MQTT) handle(msg paho.Message, command func([]byte) (events.Event, error)) {
+	e, err := command(msg.Payload())
+	if err != nil {
+		log.Errorf("Invalid MQTT Command on %s: %s", msg.Topic(), err)
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to marshal MQTT Command: %s", err)
+		return
+	}
+	log.Debugf("MQTT Command %s: %s", msg.Topic(), payload)
+	m.out <- payload
+}
+
+func (m *MQTT) pause(payload []byte) (events.Event, error) {
+	return &events.PauseEvent{Base: base(events.PAUSE_EVENT)}, nil
+}
+
+func (m *MQTT) resume(payload []byte) (events.Event, error) {
+	return &events.ResumeEvent{Base: base(events.RESUME_EVENT)}, nil
+}
+
+func (m *MQTT) skip(payload []byte) (events.Event, error) {
+	return &events.StopEvent{Base: base(events.STOP_EVENT)}, nil
+}
+
+func (m *MQTT) volume(payload []byte) (events.Event, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	e := &events.VolumeEvent{Base: base(events.VOLUME_EVENT), Volume: v}
+	return e, e.Validate()
+}
+
+// Publishes the now playing state as a retained message, track is nil when
+// nothing is playing
+func (m *MQTT) NowPlaying(state string, track *perceptor.Track, at time.Time) error {
+	np := &nowPlaying{
+		State:     state,
+		Timestamp: at,
+	}
+	if track != nil {
+		np.Track = track.Id
+		np.Uri = track.Uri
+		np.User = track.User
+	}
+	payload, err := json.Marshal(np)
+	if err != nil {
+		return err
+	}
+	return m.publish(m.config.Topics.NowPlaying, payload)
+}
+
+// Publishes a retained message to the topic
+func (m *MQTT) publish(topic string, payload []byte) error {
+	if topic == "" {
+		return nil
+	}
+	token := m.client.Publish(topic, m.config.QoS, true, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// Returns the base of a command event
+func base(t string) events.Base {
+	return events.Base{
+		Type:      t,
+		User:      "mqtt",
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// Constructs a new MQTT transport
+func New(c Config, out chan []byte, bus *events.Bus) (*MQTT, error) {
+	m := &MQTT{
+		config: c,
+		out:    out,
+		bus:    bus,
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientId).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(m.onConnectionLost)
+
+	// Mark ourselves offline if we drop off the broker
+	if c.Topics.Status != "" {
+		opts.SetWill(c.Topics.Status, "offline", c.QoS, true)
+	}
+
+	if strings.HasPrefix(c.Broker, "ssl://") || strings.HasPrefix(c.Broker, "tls://") {
+		config, err := c.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+
+	m.client = paho.NewClient(opts)
+
+	return m, nil
+}
@@ -0,0 +1,24 @@
+// Perceptor Client Interface
+
+package perceptor
+
+import (
+	"context"
+	"time"
+)
+
+// Everything SoundWave needs from Perceptor, implemented by Perceptor.
+// Replacing the client allows the player to be run against a fake. The
+// player reports events in order from its own goroutine, so reporting must
+// not block.
+type Client interface {
+	Next() (*Track, error)                        // Get the next track, errors when the playlist is empty
+	Play(t *Track, start time.Time)               // Report a track started playing
+	Pause(start time.Time)                        // Report the track was paused
+	Resume(duration int64)                        // Report the track was resumed after duration ms
+	End(t *Track)                                 // Report a track ended
+	Error(t *Track, stage string, message string) // Report a track failed to play
+	WSConnection(ctx context.Context)             // Stream events from Perceptor until the context is done
+}
+
+var _ Client = (*Perceptor)(nil)
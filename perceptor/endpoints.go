@@ -0,0 +1,278 @@
+// Perceptor endpoints with health checking and failover
+
+package perceptor
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/delivery"
+)
+
+// How endpoints are health checked
+type HealthCheck struct {
+	Interval time.Duration // Check every endpoint this often
+	Timeout  time.Duration // Give up on a check after this long
+	Rise     int           // Passed checks before a failed endpoint is used again
+	Path     string        // Path checks GET, an endpoint passes by responding with a 2xx
+}
+
+// Health check used unless SetHealthCheck is called
+var DefaultHealthCheck = HealthCheck{
+	Interval: 10 * time.Second,
+	Timeout:  2 * time.Second,
+	Rise:     3,
+	Path:     "/health",
+}
+
+// Endpoint metrics: active is the endpoint in use, failovers counts switches
+// away from a failed endpoint and health is healthy or unhealthy by endpoint
+var (
+	endpointMetrics = expvar.NewMap("perceptor_endpoints")
+	activeEndpoint  = new(expvar.String)
+	endpointHealth  = new(expvar.Map).Init()
+)
+
+func init() {
+	endpointMetrics.Set("active", activeEndpoint)
+	endpointMetrics.Set("health", endpointHealth)
+}
+
+// A Perceptor endpoint
+type endpoint struct {
+	addr    string
+	healthy bool
+	passed  int // Checks passed since the endpoint failed
+}
+
+// Sets the health of the endpoint, recording it in the metrics
+func (e *endpoint) setHealthy(healthy bool) {
+	e.healthy = healthy
+	e.passed = 0
+	health := new(expvar.String)
+	if healthy {
+		health.Set("healthy")
+	} else {
+		health.Set("unhealthy")
+	}
+	endpointHealth.Set(e.addr, health)
+}
+
+// Perceptor endpoints in order of preference, the first is the primary.
+// Requests go to the active endpoint, failing over to the next healthy one
+// when it fails and moving back to a more preferred one once it recovers.
+type endpoints struct {
+	lock    sync.Mutex
+	list    []*endpoint
+	active  int
+	rise    int           // Passed checks before a failed endpoint is used again
+	changed chan struct{} // Closed when the active endpoint changes
+}
+
+// Returns the number of endpoints
+func (e *endpoints) len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.list)
+}
+
+// Returns the addresses of every endpoint, primary first
+func (e *endpoints) addrs() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	addrs := make([]string, len(e.list))
+	for i, ep := range e.list {
+		addrs[i] = ep.addr
+	}
+	return addrs
+}
+
+// Returns the address of the active endpoint
+func (e *endpoints) current() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.list[e.active].addr
+}
+
+// Returns a channel closed when the active endpoint next changes
+func (e *endpoints) watch() <-chan struct{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.changed
+}
+
+// Marks the endpoint failed, failing over if it is active. Returns true if
+// another endpoint is now active and worth trying.
+func (e *endpoints) fail(addr string, err error) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	i := e.index(addr)
+	if i < 0 {
+		return false
+	}
+	if e.list[i].healthy {
+		log.Warnf("Perceptor endpoint %s failed: %s", addr, err)
+		e.list[i].setHealthy(false)
+	} else {
+		e.list[i].passed = 0
+	}
+	if i != e.active || len(e.list) == 1 {
+		return i != e.active
+	}
+	// Prefer a healthy endpoint, otherwise try the next one in turn
+	next := e.preferred()
+	if next < 0 {
+		next = (e.active + 1) % len(e.list)
+	}
+	e.switchTo(next)
+	return true
+}
+
+// Records the result of a health check, moving back to a more preferred
+// endpoint once it has passed enough checks in a row
+func (e *endpoints) checked(addr string, err error) {
+	if err != nil {
+		e.fail(addr, err)
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	i := e.index(addr)
+	if i < 0 {
+		return
+	}
+	if ep := e.list[i]; !ep.healthy {
+		ep.passed++
+		if ep.passed < e.rise {
+			return
+		}
+		log.Infof("Perceptor endpoint %s recovered", addr)
+		ep.setHealthy(true)
+	}
+	if best := e.preferred(); best >= 0 && best != e.active &&
+		(best < e.active || !e.list[e.active].healthy) {
+		e.switchTo(best)
+	}
+}
+
+// Returns the index of the most preferred healthy endpoint, or -1 if none
+// are healthy. The lock must be held.
+func (e *endpoints) preferred() int {
+	for i, ep := range e.list {
+		if ep.healthy {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the endpoint with the address, or -1. The lock must
+// be held.
+func (e *endpoints) index(addr string) int {
+	for i, ep := range e.list {
+		if ep.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Makes the endpoint active, the lock must be held
+func (e *endpoints) switchTo(i int) {
+	log.Warnf("Switching Perceptor endpoint from %s to %s", e.list[e.active].addr, e.list[i].addr)
+	if !e.list[e.active].healthy {
+		endpointMetrics.Add("failovers", 1)
+	}
+	e.active = i
+	activeEndpoint.Set(e.list[i].addr)
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// Constructs endpoints for the addresses, the first is the primary and is
+// active to begin with
+func newEndpoints(addrs []string, rise int) *endpoints {
+	e := &endpoints{
+		rise:    rise,
+		changed: make(chan struct{}),
+	}
+	endpointHealth.Init()
+	for _, addr := range addrs {
+		ep := &endpoint{addr: addr}
+		ep.setHealthy(true)
+		e.list = append(e.list, ep)
+	}
+	activeEndpoint.Set(addrs[0])
+	return e
+}
+
+// Health checks every endpoint until the context is done, an endpoint passes
+// the check if it responds to a signed request with a 2xx. A zero interval
+// disables health checks.
+func (p *Perceptor) MonitorEndpoints(ctx context.Context) {
+	if p.health.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, addr := range p.endpoints.addrs() {
+				p.endpoints.checked(addr, p.check(ctx, addr))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Checks the endpoint responds to a signed request with a 2xx, so one that
+// accepts connections but is failing requests is not used
+func (p *Perceptor) check(ctx context.Context, addr string) error {
+	if p.health.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.health.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("GET", p.url(addr, p.health.Path), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Signature", p.Sign("GET", p.health.Path, []byte("")))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &delivery.StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Sets the endpoints to use in order of preference, the first is the primary
+// which is used whenever it is healthy
+func (p *Perceptor) SetEndpoints(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	p.endpoints = newEndpoints(addrs, p.health.Rise)
+}
+
+// Sets how endpoints are health checked
+func (p *Perceptor) SetHealthCheck(h HealthCheck) {
+	p.health = h
+	p.endpoints.lock.Lock()
+	p.endpoints.rise = h.Rise
+	p.endpoints.lock.Unlock()
+}
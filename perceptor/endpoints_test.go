@@ -0,0 +1,44 @@
+package perceptor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		healthy bool
+	}{
+		{"ok", func(w http.ResponseWriter, r *http.Request) {}, true},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, false},
+		{"hung", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}, false},
+	}
+	for _, test := range tests {
+		signed := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signed = r.URL.Path == "/health" && r.Header.Get("Signature") != ""
+			test.handler(w, r)
+		}))
+		p := New(strings.TrimPrefix(server.URL, "http://"), "secret", nil, nil)
+		p.SetHealthCheck(HealthCheck{Timeout: 50 * time.Millisecond, Rise: 1, Path: "/health"})
+
+		err := p.check(context.Background(), p.endpoints.current())
+		if healthy := err == nil; healthy != test.healthy {
+			t.Errorf("%s: got %v, want healthy %t", test.name, err, test.healthy)
+		}
+		server.Close()
+		if !signed {
+			t.Errorf("%s: check not a signed request to the health path", test.name)
+		}
+	}
+}
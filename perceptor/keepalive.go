@@ -0,0 +1,63 @@
+// Websocket Keepalive and Reconnection Backoff
+
+package perceptor
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Timeouts keeping the websocket connection alive
+type Keepalive struct {
+	PingInterval time.Duration // How often to ping Perceptor, 0 disables pings
+	ReadTimeout  time.Duration // Reconnect when nothing, not even a pong, is read for this long, 0 waits forever
+	WriteTimeout time.Duration // Give up on a write after this long
+	MinBackoff   time.Duration // Delay before the first reconnection attempt, at least 100ms
+	MaxBackoff   time.Duration // Longest delay between reconnection attempts
+}
+
+// Shortest delay between reconnection attempts, whatever the backoff, so a
+// 0 backoff can not re-dial in a tight loop
+var minReconnectDelay = 100 * time.Millisecond
+
+// Keepalive used unless another is set
+var DefaultKeepalive = Keepalive{
+	PingInterval: 30 * time.Second,
+	ReadTimeout:  60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+	MinBackoff:   time.Second,
+	MaxBackoff:   time.Minute,
+}
+
+// Returns the delay before a reconnection attempt, doubling with each failed
+// attempt up to the max. Half the delay is random so many clients do not
+// reconnect to Perceptor in lockstep.
+func (k Keepalive) backoff(attempt int) time.Duration {
+	d := k.MinBackoff
+	for i := 0; i < attempt && d < k.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > k.MaxBackoff {
+		d = k.MaxBackoff
+	}
+	if d < 2*minReconnectDelay {
+		d = 2 * minReconnectDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Returns the read deadline from now, zero if reads never time out
+func (k Keepalive) readDeadline() time.Time {
+	if k.ReadTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(k.ReadTimeout)
+}
+
+// Returns the write deadline from now, zero if writes never time out
+func (k Keepalive) writeDeadline() time.Time {
+	if k.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(k.WriteTimeout)
+}
@@ -0,0 +1,39 @@
+package perceptor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+	k := Keepalive{}
+	if !k.readDeadline().IsZero() || !k.writeDeadline().IsZero() {
+		t.Error("0 timeouts should not set deadlines")
+	}
+
+	k = Keepalive{ReadTimeout: time.Minute, WriteTimeout: time.Second}
+	now := time.Now()
+	if d := k.readDeadline().Sub(now); d < time.Minute-time.Second || d > time.Minute+time.Second {
+		t.Errorf("read deadline %s from now", d)
+	}
+	if d := k.writeDeadline().Sub(now); d < 0 || d > 2*time.Second {
+		t.Errorf("write deadline %s from now", d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	k := Keepalive{MinBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if d := k.backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d: got %s, want %s to %s", attempt, d, max/2, max)
+		}
+	}
+
+	// A 0 backoff still waits between attempts
+	k = Keepalive{}
+	for attempt := 0; attempt < 3; attempt++ {
+		if d := k.backoff(attempt); d < minReconnectDelay {
+			t.Errorf("attempt %d: got %s with a 0 backoff", attempt, d)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Outbox for reliable delivery of events to Perceptor
+
+package perceptor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/delivery"
+	"github.com/thisissoon/FM-SoundWave/journal"
+)
+
+// Outbox metrics: backlog is the number of events waiting to be delivered,
+// delivered, retried and dropped are counters
+var (
+	outboxMetrics = expvar.NewMap("perceptor_outbox")
+	outboxBacklog = new(expvar.Int)
+)
+
+func init() {
+	outboxMetrics.Set("backlog", outboxBacklog)
+}
+
+// An event waiting in the outbox
+type outboundEvent struct {
+	Name    string          `json:"name"` // Event endpoint, e.g play
+	Key     string          `json:"key"`  // Idempotency key, the same for every attempt
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Sent by Perceptor once it has received an event sent over the websocket
+const RECEIPT_MESSAGE string = "received"
+
+// Receipt for the event with the idempotency key
+type receipt struct {
+	Event string `json:"event"`
+	Key   string `json:"key"`
+}
+
+// Returns a new random idempotency key
+func newKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Queues an event in the outbox to be POSTed to /events/<name>
+func (p *Perceptor) queue(name string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Failed to marshal %s event: %s", name, err)
+		return
+	}
+
+	p.journal.Record(journal.OUTBOUND_ENTRY, name, payload)
+
+	msg, err := json.Marshal(&outboundEvent{
+		Name:    name,
+		Key:     newKey(),
+		Payload: payload,
+	})
+	if err != nil {
+		log.Errorf("Failed to marshal %s event: %s", name, err)
+		return
+	}
+	if err := p.outbox.Push(msg); err != nil {
+		log.Errorf("Failed to queue %s event: %s", name, err)
+	}
+	outboxBacklog.Set(int64(p.outbox.Len()))
+}
+
+// Delivers queued events to Perceptor in the order they were queued until
+// the context is done, retrying failed events with backoff. Events are
+// never delivered out of order, so a track's end always follows its play.
+func (p *Perceptor) DeliverEvents(ctx context.Context) {
+	delivery.Run(ctx, p.outbox, p.send, p.sent)
+}
+
+// Sends an event from the outbox
+func (p *Perceptor) send(ctx context.Context, data []byte) error {
+	e := &outboundEvent{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return err
+	}
+	return p.deliver(ctx, e)
+}
+
+// Records the outcome of sending an event from the outbox
+func (p *Perceptor) sent(data []byte, err error, retry time.Duration) {
+	e := &outboundEvent{}
+	json.Unmarshal(data, e)
+	switch {
+	case retry > 0:
+		outboxMetrics.Add("retried", 1)
+		log.Warnf("Failed to deliver %s event, retrying in %s: %s", e.Name, retry, err)
+	case err != nil:
+		outboxMetrics.Add("dropped", 1)
+		log.Errorf("Perceptor rejected %s event %s: %s", e.Name, e.Payload, err)
+	default:
+		outboxMetrics.Add("delivered", 1)
+	}
+	outboxBacklog.Set(int64(p.outbox.Len()))
+}
+
+// Blocks until every queued event has been delivered or the context is done
+func (p *Perceptor) Flush(ctx context.Context) error {
+	return delivery.Flush(ctx, p.outbox)
+}
+
+// Sends an event over the websocket if enabled, falling back to HTTP. An
+// event sent over the websocket is only delivered once Perceptor sends a
+// receipt for its key, as a write can succeed on a connection that has
+// silently gone away. Without a receipt it is POSTed with the same key.
+func (p *Perceptor) deliver(ctx context.Context, e *outboundEvent) error {
+	if p.wsEvents {
+		received := p.awaitReceipt(e.Key)
+		defer p.forgetReceipt(e.Key)
+		err := p.sendMessage(e.Name, e.Key, e.Payload)
+		if err == nil {
+			select {
+			case <-received:
+				log.Infof("WS %s: %s", e.Name, e.Payload)
+				return nil
+			case <-time.After(p.receipt):
+				err = errors.New("no receipt")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		log.Debugf("Failed to send %s event over websocket, using HTTP: %s", e.Name, err)
+	}
+	return p.post(ctx, e)
+}
+
+// Returns a channel closed once Perceptor sends a receipt for the key
+func (p *Perceptor) awaitReceipt(key string) <-chan struct{} {
+	p.rLock.Lock()
+	defer p.rLock.Unlock()
+	c := make(chan struct{})
+	p.receipts[key] = c
+	return c
+}
+
+// Stops waiting for a receipt for the key
+func (p *Perceptor) forgetReceipt(key string) {
+	p.rLock.Lock()
+	defer p.rLock.Unlock()
+	delete(p.receipts, key)
+}
+
+// Returns true if the inbound message is a receipt, marking the event it is
+// for as received
+func (p *Perceptor) received(msg []byte) bool {
+	r := &receipt{}
+	if json.Unmarshal(msg, r) != nil || r.Event != RECEIPT_MESSAGE {
+		return false
+	}
+	p.rLock.Lock()
+	defer p.rLock.Unlock()
+	if c, ok := p.receipts[r.Key]; ok {
+		close(c)
+		delete(p.receipts, r.Key)
+	}
+	return true
+}
+
+// POSTs an event to Perceptor
+func (p *Perceptor) post(ctx context.Context, e *outboundEvent) error {
+	header := http.Header{}
+	header.Set("Idempotency-Key", e.Key)
+	resp, err := p.do(ctx, "POST", "/events/"+e.Name, e.Payload, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	log.Infof("POST %s: %v", resp.Request.URL, resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &delivery.StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
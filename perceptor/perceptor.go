@@ -3,29 +3,51 @@
 package perceptor
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/journal"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/spool"
 )
 
+// Events queued in memory before the oldest are dropped
+var outboxSize = 1000
+
 // Provides an interface to Perceptor
 type Perceptor struct {
-	addr     string           // address to Perceptor
-	secret   string           // soundwaves client key
-	channel  chan []byte      // channel to send events too
-	channels *events.Channels // Event channels
+	endpoints *endpoints        // Perceptor addresses, primary first
+	health    HealthCheck       // How endpoints are health checked
+	signer    *signature.Signer // Signs requests and verifies inbound messages
+	channel   chan []byte       // channel to send events too
+	bus       *events.Bus       // Bus to publish connection events to
+	journal   *journal.Journal
+	tls       bool              // Connect over https and wss
+	client    *http.Client      // Shared by all HTTP requests
+	dialer    *websocket.Dialer // Dials the websocket
+	outbox    *spool.Spool      // Events waiting to be delivered
+	keepalive Keepalive
+	wsEvents  bool                     // Send events over the websocket when connected
+	status    func() *Status           // Player status for snapshots and heartbeats
+	heartbeat time.Duration            // How often to send heartbeats
+	receipt   time.Duration            // How long to wait for Perceptor to receive a websocket event
+	receipts  map[string]chan struct{} // Closed when the event with the key is received, by key
+	rLock     sync.Mutex               // Guards receipts
+	wsLock    sync.Mutex               // Serialises writes to the websocket
+	ws        *websocket.Conn          // Current websocket connection, nil when disconnected
+	verify    bool                     // Only accept signed inbound messages
+	rejected  *events.DeadLetters      // Inbound messages failing verification
 }
 
 type playEvent struct {
@@ -47,32 +69,27 @@ type endEvent struct {
 	User string `json:"user"`
 }
 
-// Generates a HMAC Signature for the given data blob
-func (p *Perceptor) Sign(d []byte) string {
-	mac := hmac.New(sha256.New, []byte(p.secret))
-	mac.Write(d)
-	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+type errorEvent struct {
+	Uri     string `json:"uri"`
+	User    string `json:"user"`
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+}
 
-	return fmt.Sprintf("%s:%s", "soundwave", sig)
+// Generates a Signature for a request to the path with the given data blob
+func (p *Perceptor) Sign(method string, path string, d []byte) string {
+	return p.signer.Sign(method, path, d, time.Now())
 }
 
 // Get the next tack from Perceptor
 func (p *Perceptor) Next() (*Track, error) {
-	// Build urls / client and payload
-	url := fmt.Sprintf("http://%s/playlist/next", p.addr)
-	client := &http.Client{}
-	payload := []byte("")
-
-	// Create Request
-	req, _ := http.NewRequest("GET", url, bytes.NewBuffer(payload))
-	req.Header.Add("Signature", p.Sign(payload))
-
-	// Execute Request
-	resp, err := client.Do(req)
-	log.Debugf("GET %s", url)
+	// Execute Request, failing over to the next endpoint
+	resp, err := p.do(context.Background(), "GET", "/playlist/next", []byte(""), nil)
 	if err != nil {
 		log.Errorf("Error getting next track: %s", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	// Playlist is empty or errored
 	if resp.StatusCode != 200 {
@@ -80,7 +97,6 @@ func (p *Perceptor) Next() (*Track, error) {
 	}
 
 	// Read body and make a Track
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Errorf("Error getting reading next track: %v", err)
@@ -96,151 +112,292 @@ func (p *Perceptor) Next() (*Track, error) {
 	return t, nil
 }
 
-// POST's play event to perspector
+// Queues a play event for perspector
 func (p *Perceptor) Play(t *Track, start time.Time) {
-	// Build urls / client
-	url := fmt.Sprintf("http://%s/events/play", p.addr)
-	client := &http.Client{}
-
-	// Create payload
-	payload, err := json.Marshal(&playEvent{
+	p.queue("play", &playEvent{
 		Start: start.Format(time.RFC3339),
 		Uri:   t.Uri,
 		User:  t.User,
 	})
-	if err != nil {
-		log.Errorf("Failed to marshal Track: %s", err)
-	}
-
-	// Create Request
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	req.Header.Add("Signature", p.Sign(payload))
-
-	// Make request and log
-	resp, err := client.Do(req)
-	log.Infof("POST %s: %v", url, resp.StatusCode)
 }
 
-// POST's pause event to perspector
+// Queues a pause event for perspector
 func (p *Perceptor) Pause(start time.Time) {
-	// Build urls / client
-	url := fmt.Sprintf("http://%s/events/pause", p.addr)
-	client := &http.Client{}
-
-	// Create payload
-	payload, err := json.Marshal(&pauseEvent{
+	p.queue("pause", &pauseEvent{
 		Start: start.Format(time.RFC3339),
 	})
-	if err != nil {
-		log.Errorf("Failed to marshal pause event: %s", err)
-	}
-
-	// Create Request
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	req.Header.Add("Signature", p.Sign(payload))
-
-	// Make request and log
-	resp, err := client.Do(req)
-	log.Infof("POST %s: %v", url, resp.StatusCode)
 }
 
-// POST's pause event to perspector
+// Queues a resume event for perspector
 func (p *Perceptor) Resume(duration int64) {
-	// Build urls / client
-	url := fmt.Sprintf("http://%s/events/resume", p.addr)
-	client := &http.Client{}
-
-	// Create payload
-	payload, err := json.Marshal(&resumeEvent{
+	p.queue("resume", &resumeEvent{
 		Duration: strconv.FormatInt(duration, 10),
 	})
-	if err != nil {
-		log.Errorf("Failed to marshal resume event: %s", err)
-	}
-
-	// Create Request
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	req.Header.Add("Signature", p.Sign(payload))
-
-	// Make request and log
-	resp, err := client.Do(req)
-	log.Infof("POST %s: %v", url, resp.StatusCode)
 }
 
-// POST's end event to perspector
+// Queues an end event for perspector
 func (p *Perceptor) End(track *Track) {
-	// Build urls / client
-	url := fmt.Sprintf("http://%s/events/end", p.addr)
-	client := &http.Client{}
-
-	// Create payload
-	payload, err := json.Marshal(&endEvent{
+	p.queue("end", &endEvent{
 		Uri:  track.Uri,
 		User: track.User,
 	})
-	if err != nil {
-		log.Errorf("Failed to marshal end event: %s", err)
-	}
-
-	// Create Request
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	req.Header.Add("Signature", p.Sign(payload))
-
-	// Make request and log
-	resp, err := client.Do(req)
-	log.Infof("POST %s: %v", url, resp.StatusCode)
 }
 
-// Starts a websocket connection to the Perceptor Event Service
-func (p *Perceptor) WSConnection() {
-	log.Infof("Starting Websocket Connection too: %s", p.addr)
+// Queues an error event for perspector, sent in place of an end event when
+// a track could not be played
+func (p *Perceptor) Error(track *Track, stage string, message string) {
+	p.queue("error", &errorEvent{
+		Uri:     track.Uri,
+		User:    track.User,
+		Stage:   stage,
+		Message: message,
+	})
+}
 
-	// Create the dialer
-	d := &websocket.Dialer{
-		ReadBufferSize:  4096,
-		WriteBufferSize: 4096,
-	}
+// Queues a rejected event for perspector, used in strict mode to report
+// event types we do not support
+func (p *Perceptor) Rejected(r *events.Rejection) {
+	p.queue("rejected", r)
+}
 
-	// Make Headers
-	headers := http.Header{}
-	headers.Add("Signature", p.Sign([]byte("")))
+// Starts a websocket connection to the Perceptor Event Service, reconnecting
+// with backoff until the context is done. Connection events are published
+// on the bus whenever the connection is made or lost.
+func (p *Perceptor) WSConnection(ctx context.Context) {
+	log.Infof("Starting Websocket Connection too: %s", strings.Join(p.endpoints.addrs(), ", "))
 
 	// Connect to the WS Service
-	for {
-		conn, _, err := d.Dial(fmt.Sprintf("ws://%s", p.addr), headers)
+	connected := true // So the first failure is published
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		// Signed on each dial as signatures are timestamped
+		headers := http.Header{}
+		headers.Add("Signature", p.Sign("GET", "/", []byte("")))
+		changed := p.endpoints.watch()
+		addr := p.endpoints.current()
+		conn, _, err := p.dialer.Dial(p.wsURL(addr), headers)
 		if err != nil {
-			log.Errorf("WS Dial Error: %s", err)
-			time.Sleep(time.Second)
+			if connected {
+				p.publishConnection(addr, false, err)
+				connected = false
+			}
+			p.endpoints.fail(addr, err)
+			delay := p.keepalive.backoff(attempt)
+			log.Errorf("WS Dial Error, retrying in %s: %s", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
 			continue
 		}
-		log.Infof("Connected to: %s", p.addr)
+		log.Infof("Connected to: %s", addr)
+		attempt = -1 // Reset the backoff
+		connected = true
+		p.setConn(conn)
+		// Keep the connection alive and close it once we are done,
+		// unblocking the read
+		closed := make(chan struct{})
+		go p.keepAlive(ctx, conn, closed, changed)
 		// Always ensure we unblock the player when we restore connections
-		if len(p.channels.CheckNext) == 0 {
-			p.channels.CheckNext <- true
+		p.publishConnection(addr, true, nil)
+		// Let Perceptor resynchronise with us
+		if p.wsEvents {
+			p.sendStatus(SNAPSHOT_MESSAGE)
+		}
+		err = p.read(ctx, conn)
+		close(closed)
+		p.setConn(nil)
+		conn.Close()
+		p.publishConnection(addr, false, err)
+		connected = false
+		// Only a lost connection counts against the endpoint, not one
+		// closed to move to another endpoint
+		select {
+		case <-changed:
+		default:
+			if ctx.Err() == nil {
+				p.endpoints.fail(addr, err)
+			}
+		}
+	}
+	log.Info("Websocket Connection closed")
+}
+
+// Reads messages from the connection until it errors, a read times out or
+// the context is done
+func (p *Perceptor) read(ctx context.Context, conn *websocket.Conn) error {
+	// Any message, including pongs, keeps the connection alive
+	conn.SetReadDeadline(p.keepalive.readDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(p.keepalive.readDeadline())
+	})
+	for {
+		// Read the messages, returning on Error
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			log.Errorf("WS Read Message Error: %s", err)
+			return err
 		}
-	ReadLoop:
-		for {
-			// Read the messages, breaking on Error
-			if msgType, msg, err := conn.ReadMessage(); err != nil {
-				log.Errorf("WS Read Message Error: %s", err)
-				break ReadLoop
-			} else {
-				// Only act on the message if it's Text
-				if msgType == websocket.TextMessage {
-					p.channel <- msg
+		conn.SetReadDeadline(p.keepalive.readDeadline())
+		// Only act on the message if it's Text
+		if msgType == websocket.TextMessage {
+			if p.verify {
+				data, err := p.unwrap(msg)
+				if err != nil {
+					p.rejected.Reject(msg, events.UNSIGNED_REJECTION, "", err)
+					continue
 				}
+				msg = data
+			}
+			if p.received(msg) {
+				continue
+			}
+			// Recorded once verified so replay sees the event itself
+			p.journal.Record(journal.INBOUND_ENTRY, "websocket", msg)
+			select {
+			case p.channel <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
-		conn.Close()
 	}
 }
 
+// Pings Perceptor and sends heartbeats until the connection is closed,
+// closing it once the context is done or the active endpoint changes
+func (p *Perceptor) keepAlive(ctx context.Context, conn *websocket.Conn, closed chan struct{}, changed <-chan struct{}) {
+	var ping, heartbeat <-chan time.Time
+	if p.keepalive.PingInterval > 0 {
+		ticker := time.NewTicker(p.keepalive.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	if p.wsEvents && p.heartbeat > 0 {
+		ticker := time.NewTicker(p.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-heartbeat:
+			p.sendStatus(HEARTBEAT_MESSAGE)
+		case <-ping:
+			if err := p.ping(conn); err != nil {
+				log.Errorf("WS Ping Error: %s", err)
+				conn.Close() // Unblocks the read so we reconnect
+				return
+			}
+		case <-ctx.Done():
+			p.closeConn(conn)
+			return
+		case <-changed:
+			log.Infof("Perceptor endpoint changed, reconnecting")
+			p.closeConn(conn)
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Sends a ping, Perceptor replies with a pong
+func (p *Perceptor) ping(conn *websocket.Conn) error {
+	p.wsLock.Lock()
+	defer p.wsLock.Unlock()
+	return conn.WriteControl(websocket.PingMessage, nil, p.keepalive.writeDeadline())
+}
+
+// Publishes a connection event for the endpoint, with the error the
+// connection was lost to
+func (p *Perceptor) publishConnection(addr string, connected bool, err error) {
+	e := events.NewConnectionEvent(addr, connected)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.bus.Publish(e)
+}
+
+// Sends a close message so Perceptor knows we are going away, then closes
+// the connection
+func (p *Perceptor) closeConn(conn *websocket.Conn) {
+	p.wsLock.Lock()
+	defer p.wsLock.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+	conn.WriteControl(websocket.CloseMessage, msg, p.keepalive.writeDeadline())
+	conn.Close()
+}
+
+// Sets the current websocket connection
+func (p *Perceptor) setConn(conn *websocket.Conn) {
+	p.wsLock.Lock()
+	defer p.wsLock.Unlock()
+	p.ws = conn
+}
+
+// Writes a text message to the websocket, only one write may happen at a time
+func (p *Perceptor) writeMessage(msg []byte) error {
+	p.wsLock.Lock()
+	defer p.wsLock.Unlock()
+	if p.ws == nil {
+		return errors.New("websocket not connected")
+	}
+	p.ws.SetWriteDeadline(p.keepalive.writeDeadline())
+	return p.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Sends an event acknowledgement over the websocket
+func (p *Perceptor) Ack(a *events.Ack) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	p.journal.Record(journal.OUTBOUND_ENTRY, events.ACK_EVENT, payload)
+	return p.writeMessage(payload)
+}
+
+// Sets the outbox events are queued in, by default events are queued in
+// memory and lost on exit
+func (p *Perceptor) SetOutbox(s *spool.Spool) {
+	p.outbox = s
+	outboxBacklog.Set(int64(s.Len()))
+}
+
+// Sets the websocket keepalive timeouts and reconnection backoff
+func (p *Perceptor) SetKeepalive(k Keepalive) {
+	p.keepalive = k
+}
+
+// Sets the signer requests are signed with, by default requests are signed
+// with the V1 scheme
+func (p *Perceptor) SetSigner(s *signature.Signer) {
+	p.signer = s
+}
+
+// Only accept inbound websocket messages signed by Perceptor, rejecting the
+// rest to the dead letters
+func (p *Perceptor) SetVerifyInbound(verify bool, deadLetters *events.DeadLetters) {
+	p.verify = verify
+	p.rejected = deadLetters
+}
+
+// Records inbound messages and outbound events to the journal
+func (p *Perceptor) SetJournal(j *journal.Journal) {
+	p.journal = j
+}
+
 // Constructs a new Perceptor instance
-func New(a string, s string, c chan []byte, channels *events.Channels) *Perceptor {
+func New(a string, s string, c chan []byte, bus *events.Bus) *Perceptor {
+	outbox, _ := spool.Open("", outboxSize)
+	client, dialer := newTransport(nil)
 	return &Perceptor{
-		addr:     a,
-		secret:   s,
-		channel:  c,
-		channels: channels,
+		endpoints: newEndpoints([]string{a}, DefaultHealthCheck.Rise),
+		health:    DefaultHealthCheck,
+		signer:    signature.NewSigner(signature.V1, signature.CLIENT_NAME, []string{s}, 0),
+		channel:   c,
+		bus:       bus,
+		client:    client,
+		dialer:    dialer,
+		outbox:    outbox,
+		keepalive: DefaultKeepalive,
+		receipts:  make(map[string]chan struct{}),
 	}
 }
@@ -0,0 +1,274 @@
+package perceptor_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/journal"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+	"github.com/thisissoon/FM-SoundWave/perceptortest"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/tlsutil"
+)
+
+// Verified inbound messages are journaled without their signature wrapper,
+// so they can be replayed
+func TestJournalVerifiedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+	j, err := journal.Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := perceptortest.NewServer("secret")
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	pcptr := perceptor.New(server.Addr(), "secret", received, events.NewBus())
+	pcptr.SetSigner(signature.NewSigner(signature.V1, signature.CLIENT_NAME, []string{"secret"}, time.Minute))
+	pcptr.SetVerifyInbound(true, events.NewDeadLetters(nil, nil, false))
+	pcptr.SetJournal(j)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pcptr.WSConnection(ctx)
+
+	msg := []byte(`{"event":"add","uri":"spotify:track:a"}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for err := server.SendSigned(msg); err != nil; err = server.SendSigned(msg) {
+		if time.Now().After(deadline) {
+			t.Fatalf("SoundWave did not connect: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	j.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := journal.NewReader(f)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			t.Fatal("message not journaled")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind != journal.INBOUND_ENTRY {
+			continue
+		}
+		if _, err := events.Decode(e.Data); err != nil {
+			t.Errorf("journaled %s can not be replayed: %s", e.Data, err)
+		}
+		return
+	}
+}
+
+// Starts delivering events over the websocket, returning once it is
+// connected
+func startWebsocketEvents(t *testing.T, server *perceptortest.Server, receipt time.Duration, verify bool) (*perceptor.Perceptor, context.CancelFunc) {
+	pcptr := perceptor.New(server.Addr(), "secret", make(chan []byte, 1), events.NewBus())
+	pcptr.SetVerifyInbound(verify, events.NewDeadLetters(nil, nil, false))
+	status := func() *perceptor.Status { return &perceptor.Status{} }
+	pcptr.SetWebsocketEvents(status, 0, receipt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go pcptr.WSConnection(ctx)
+	go pcptr.DeliverEvents(ctx)
+
+	// The snapshot is sent once connected
+	if _, err := server.WaitFor(perceptortest.WEBSOCKET_EVENT, 2*time.Second); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	return pcptr, cancel
+}
+
+// Returns the events with the name and key received so far
+func eventsFor(server *perceptortest.Server, name string, key string) []*perceptortest.Event {
+	var found []*perceptortest.Event
+	for _, e := range server.Events() {
+		if e.Name == name && e.Key == key {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// Events received by Perceptor over the websocket are not POSTed, whether
+// or not receipts are verified
+func TestWebsocketEventReceived(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		server := perceptortest.NewServer("secret")
+		server.SetReceipts(true, verify)
+		pcptr, cancel := startWebsocketEvents(t, server, time.Minute, verify)
+
+		pcptr.Pause(time.Now())
+		ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := pcptr.Flush(ctx); err != nil {
+			t.Errorf("verify %t: %s", verify, err)
+		}
+		done()
+		if _, err := server.WaitFor("pause", 200*time.Millisecond); err == nil {
+			t.Errorf("verify %t: received pause was POSTed", verify)
+		}
+		cancel()
+		server.Close()
+	}
+}
+
+// Events Perceptor sends no receipt for are POSTed with the same key, as the
+// websocket may have gone away after the write
+func TestWebsocketEventWithoutReceipt(t *testing.T) {
+	server := perceptortest.NewServer("secret")
+	defer server.Close()
+	server.SetReceipts(false, false)
+	pcptr, cancel := startWebsocketEvents(t, server, 50*time.Millisecond, false)
+	defer cancel()
+
+	pcptr.Pause(time.Now())
+	e, err := server.WaitFor("pause", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventsFor(server, perceptortest.WEBSOCKET_EVENT, e.Key)) != 1 {
+		t.Errorf("POSTed pause key %q was not sent over the websocket", e.Key)
+	}
+}
+
+// Talks to Perceptor over https and wss, trusting the CA bundle it is given
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := perceptortest.NewTLSServer("secret")
+	defer server.Close()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := server.WriteCA(ca); err != nil {
+		t.Fatal(err)
+	}
+	config, err := tlsutil.Config{CA: ca}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Perceptor is not trusted without the CA bundle
+	pcptr := perceptor.New(server.Addr(), "secret", nil, events.NewBus())
+	pcptr.SetTLS(&tls.Config{})
+	if _, err := pcptr.Next(); err == nil {
+		t.Error("untrusted Perceptor was used")
+	}
+
+	received := make(chan []byte, 1)
+	pcptr = perceptor.New(server.Addr(), "secret", received, events.NewBus())
+	pcptr.SetTLS(config)
+
+	server.Queue(&perceptor.Track{Id: "a", Uri: "spotify:track:a"})
+	track, err := pcptr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track == nil || track.Id != "a" {
+		t.Errorf("got track %v", track)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pcptr.WSConnection(ctx)
+	go pcptr.DeliverEvents(ctx)
+
+	msg := []byte(`{"event":"add","uri":"spotify:track:a"}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for err := server.Send(msg); err != nil; err = server.Send(msg) {
+		if time.Now().After(deadline) {
+			t.Fatalf("SoundWave did not connect: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	pcptr.Pause(time.Now())
+	if _, err := server.WaitFor("pause", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Unsigned(); n != 0 {
+		t.Errorf("%d requests were not signed", n)
+	}
+}
+
+// Inbound messages must have V2 signatures even when requests are signed
+// with V1, as V1 signatures never expire
+func TestVerifyInboundRequiresV2(t *testing.T) {
+	server := perceptortest.NewServer("secret")
+	defer server.Close()
+
+	received := make(chan []byte, 2)
+	rejected := events.NewDeadLetters(nil, nil, false)
+	pcptr := perceptor.New(server.Addr(), "secret", received, events.NewBus())
+	pcptr.SetSigner(signature.NewSigner(signature.V1, signature.CLIENT_NAME, []string{"secret"}, time.Minute))
+	pcptr.SetVerifyInbound(true, rejected)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pcptr.WSConnection(ctx)
+
+	v1 := []byte(`{"event":"add","uri":"spotify:track:v1"}`)
+	signed, err := json.Marshal(map[string]interface{}{
+		"data":      json.RawMessage(v1),
+		"signature": pcptr.Sign("WS", "/", v1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for err := server.Send(signed); err != nil; err = server.Send(signed) {
+		if time.Now().After(deadline) {
+			t.Fatalf("SoundWave did not connect: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v2 := []byte(`{"event":"add","uri":"spotify:track:v2"}`)
+	if err := server.SendSigned(v2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg) != string(v2) {
+			t.Errorf("accepted %s", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	if n := len(rejected.Recent()); n != 1 {
+		t.Errorf("%d messages rejected", n)
+	}
+}
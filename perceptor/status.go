@@ -0,0 +1,108 @@
+// Player Status and Events over the Websocket
+
+package perceptor
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/journal"
+	"github.com/thisissoon/FM-SoundWave/signature"
+)
+
+// Websocket messages sent about the player status
+const (
+	SNAPSHOT_MESSAGE  string = "snapshot"  // Full status, sent when the connection opens
+	HEARTBEAT_MESSAGE string = "heartbeat" // Status sent periodically whilst connected
+)
+
+// Player status sent in snapshots and heartbeats
+type Status struct {
+	State    string `json:"state"`
+	Track    *Track `json:"track,omitempty"`
+	Position int64  `json:"position"` // Playback position in ms
+}
+
+// A signed message sent over the websocket
+type wsMessage struct {
+	Event     string          `json:"event"`
+	Key       string          `json:"key,omitempty"` // Idempotency key of queued events
+	Data      json.RawMessage `json:"data"`
+	Signature string          `json:"signature"` // Signature of data
+}
+
+// A signed message received over the websocket, the data is the event
+type signedMessage struct {
+	Data      json.RawMessage `json:"data"`
+	Signature string          `json:"signature"` // Signature of data
+}
+
+// Verifies a signed inbound message, returning the event it carries. A V2
+// signature is required whatever version outbound requests are signed with,
+// as a V1 signature has no timestamp and could be replayed forever.
+func (p *Perceptor) unwrap(msg []byte) ([]byte, error) {
+	m := &signedMessage{}
+	if err := json.Unmarshal(msg, m); err != nil {
+		return nil, err
+	}
+	if len(m.Data) == 0 || m.Signature == "" {
+		return nil, errors.New("message is not signed")
+	}
+	if !strings.HasPrefix(m.Signature, "v2:") {
+		return nil, signature.ErrMalformedSignature
+	}
+	if err := p.signer.Verify("WS", "/", m.Data, m.Signature, time.Now()); err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// Sends a signed message over the websocket
+func (p *Perceptor) sendMessage(event string, key string, data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("invalid " + event + " data")
+	}
+	msg, err := json.Marshal(&wsMessage{
+		Event:     event,
+		Key:       key,
+		Data:      data,
+		Signature: p.Sign("WS", "/"+event, data),
+	})
+	if err != nil {
+		return err
+	}
+	return p.writeMessage(msg)
+}
+
+// Sends the player status over the websocket as a snapshot or heartbeat
+func (p *Perceptor) sendStatus(event string) {
+	if p.status == nil {
+		return
+	}
+	data, err := json.Marshal(p.status())
+	if err != nil {
+		log.Errorf("Failed to marshal %s: %s", event, err)
+		return
+	}
+	if event == SNAPSHOT_MESSAGE {
+		p.journal.Record(journal.OUTBOUND_ENTRY, event, data)
+	}
+	if err := p.sendMessage(event, "", data); err != nil {
+		log.Errorf("Failed to send %s: %s", event, err)
+	}
+}
+
+// Sends events over the websocket in place of HTTP, falling back to HTTP
+// when the websocket is down or Perceptor sends no receipt for an event
+// within the receipt timeout. The status function is sent as a snapshot
+// when the connection opens and as heartbeats every heartbeat interval, a
+// zero interval sends no heartbeats.
+func (p *Perceptor) SetWebsocketEvents(status func() *Status, heartbeat time.Duration, receipt time.Duration) {
+	p.wsEvents = true
+	p.status = status
+	p.heartbeat = heartbeat
+	p.receipt = receipt
+}
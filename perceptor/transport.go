@@ -0,0 +1,106 @@
+// HTTP Client and Websocket Dialer shared by all Perceptor calls
+
+package perceptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/thisissoon/FM-SoundWave/delivery"
+)
+
+// Timeout for HTTP requests to Perceptor
+var requestTimeout = 10 * time.Second
+
+// Builds the HTTP client and websocket dialer, using TLS if a config is given
+func newTransport(config *tls.Config) (*http.Client, *websocket.Dialer) {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	client := &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			Dial:                dialer.Dial,
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+	ws := &websocket.Dialer{
+		NetDial:          dialer.Dial,
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  config,
+		ReadBufferSize:   4096,
+		WriteBufferSize:  4096,
+		HandshakeTimeout: 10 * time.Second,
+	}
+	return client, ws
+}
+
+// Returns the URL of the path on the Perceptor endpoint
+func (p *Perceptor) url(addr string, path string) string {
+	scheme := "http"
+	if p.tls {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, addr, path)
+}
+
+// Returns the URL of the Perceptor Event Service websocket on the endpoint
+func (p *Perceptor) wsURL(addr string) string {
+	scheme := "ws"
+	if p.tls {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s", scheme, addr)
+}
+
+// Sends a signed request to the active endpoint, failing over to the next
+// endpoint when it can not be reached or responds with a server error
+func (p *Perceptor) do(ctx context.Context, method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	attempts := p.endpoints.len()
+	for attempt := 1; ; attempt++ {
+		addr := p.endpoints.current()
+		req, err := http.NewRequest(method, p.url(addr, path), bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Signature", p.Sign(method, path, body))
+
+		resp, err := p.client.Do(req)
+		log.Debugf("%s %s", method, req.URL)
+		if ctx.Err() != nil || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		reason := err
+		if err == nil {
+			reason = &delivery.StatusError{Code: resp.StatusCode}
+		}
+		if !p.endpoints.fail(addr, reason) || attempt >= attempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// Connects to Perceptor over https and wss using the TLS config, which sets
+// the CAs to verify Perceptor with, client certificates and server name
+func (p *Perceptor) SetTLS(config *tls.Config) {
+	p.tls = true
+	p.client, p.dialer = newTransport(config)
+}
@@ -0,0 +1,333 @@
+// Fake Perceptor server for tests
+//
+// Serves the playlist and event endpoints and the websocket SoundWave
+// connects to, checking every request is signed with the secret.
+
+package perceptortest
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+	"github.com/thisissoon/FM-SoundWave/signature"
+)
+
+// Name events received over the websocket are recorded as
+const WEBSOCKET_EVENT string = "websocket"
+
+// An event received from SoundWave
+type Event struct {
+	Name string // Event endpoint, e.g play, or websocket for websocket messages
+	Key  string // Idempotency key sent with the event
+	Body []byte
+	Time time.Time
+}
+
+// Decodes the event body into v
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Body, v)
+}
+
+// Fake Perceptor HTTP and websocket server
+type Server struct {
+	signer   *signature.Signer // Verifies requests, V1 and V2 signatures are accepted
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+	lock     sync.Mutex
+	queue    []*perceptor.Track // Tracks served by /playlist/next
+	events   []*Event           // Events received, oldest first
+	conns    []*websocket.Conn  // Connected websockets
+	unsigned int                // Requests rejected for a bad signature
+	status   int                // Status health checks respond with
+	receipts bool               // Send receipts for websocket events
+	signed   bool               // Sign receipts like SendSigned
+	received chan struct{}      // Signalled when an event is recorded
+}
+
+// Returns the address to give perceptor.New, host:port without a scheme
+func (s *Server) Addr() string {
+	return s.server.Listener.Addr().String()
+}
+
+// Writes the certificate of a TLS server as a PEM CA bundle, to load with
+// tlsutil.Config
+func (s *Server) WriteCA(path string) error {
+	cert := s.server.Certificate()
+	if cert == nil {
+		return errors.New("not a TLS server")
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return ioutil.WriteFile(path, ca, 0600)
+}
+
+// Adds tracks to the back of the playlist
+func (s *Server) Queue(tracks ...*perceptor.Track) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queue = append(s.queue, tracks...)
+}
+
+// Returns the events received so far, oldest first
+func (s *Server) Events() []*Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := make([]*Event, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// Returns the number of requests rejected for a bad signature
+func (s *Server) Unsigned() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.unsigned
+}
+
+// Waits for an event with the name to be received, returning the first one
+// or an error once the timeout expires
+func (s *Server) WaitFor(name string, timeout time.Duration) (*Event, error) {
+	deadline := time.After(timeout)
+	for {
+		for _, e := range s.Events() {
+			if e.Name == name {
+				return e, nil
+			}
+		}
+		select {
+		case <-s.received:
+		case <-deadline:
+			return nil, errors.New("timed out waiting for " + name + " event")
+		}
+	}
+}
+
+// Sends a message to every connected websocket, e.g. an add event
+func (s *Server) Send(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.conns) == 0 {
+		return errors.New("no websocket connections")
+	}
+	for _, conn := range s.conns {
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends a message signed with the V2 scheme to every connected websocket,
+// as SoundWave expects when verifying inbound messages
+func (s *Server) SendSigned(msg []byte) error {
+	signed, err := s.sign(msg)
+	if err != nil {
+		return err
+	}
+	return s.Send(signed)
+}
+
+// Wraps a message with a V2 signature
+func (s *Server) sign(msg []byte) ([]byte, error) {
+	signer := signature.NewSigner(signature.V2, s.signer.ClientId, s.signer.Secrets, s.signer.MaxAge)
+	return json.Marshal(map[string]interface{}{
+		"data":      json.RawMessage(msg),
+		"signature": signer.Sign("WS", "/", msg, time.Now()),
+	})
+}
+
+// Sets the status /health responds with, e.g. a 503 to fail health checks
+func (s *Server) SetHealth(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+// Sets whether receipts are sent for events received over the websocket, on
+// by default, and whether they are signed like SendSigned for SoundWave
+// verifying inbound messages. Without them SoundWave POSTs the events instead.
+func (s *Server) SetReceipts(on bool, signed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receipts = on
+	s.signed = signed
+}
+
+// Closes every websocket connection, SoundWave should reconnect
+func (s *Server) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Shuts down the server
+func (s *Server) Close() {
+	s.Disconnect()
+	s.server.Close()
+}
+
+// Records an event
+func (s *Server) record(name string, key string, body []byte) {
+	s.lock.Lock()
+	s.events = append(s.events, &Event{Name: name, Key: key, Body: body, Time: time.Now()})
+	s.lock.Unlock()
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+}
+
+// Reads the request body, rejecting it if the signature does not match
+func (s *Server) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if s.signer.Verify(r.Method, r.URL.Path, body, r.Header.Get("Signature"), time.Now()) != nil {
+		s.lock.Lock()
+		s.unsigned++
+		s.lock.Unlock()
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// Serves the next track, 204 when the playlist is empty
+func (s *Server) next(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.verify(w, r); !ok {
+		return
+	}
+	s.lock.Lock()
+	if len(s.queue) == 0 {
+		s.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	t := s.queue[0]
+	s.queue = s.queue[1:]
+	s.lock.Unlock()
+	json.NewEncoder(w).Encode(t)
+}
+
+// Passes health checks, unless the server has been made unhealthy
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.verify(w, r); !ok {
+		return
+	}
+	s.lock.Lock()
+	status := s.status
+	s.lock.Unlock()
+	w.WriteHeader(status)
+}
+
+// Records events POSTed to /events/<name>
+func (s *Server) event(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, ok := s.verify(w, r)
+	if !ok {
+		return
+	}
+	s.record(strings.TrimPrefix(r.URL.Path, "/events/"), r.Header.Get("Idempotency-Key"), body)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Upgrades to a websocket, recording messages received on it and sending
+// receipts for those with an idempotency key
+func (s *Server) websocket(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.verify(w, r); !ok {
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conns = append(s.conns, conn)
+	s.lock.Unlock()
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		m := &struct {
+			Key string `json:"key"`
+		}{}
+		json.Unmarshal(msg, m)
+		s.record(WEBSOCKET_EVENT, m.Key, msg)
+		if err := s.receipt(conn, m.Key); err != nil {
+			break
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, c := range s.conns {
+		if c == conn {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+}
+
+// Sends a receipt for the key if receipts are on, held under the lock so it
+// is never written at the same time as a message from Send
+func (s *Server) receipt(conn *websocket.Conn, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if key == "" || !s.receipts {
+		return nil
+	}
+	msg, err := json.Marshal(map[string]string{"event": "received", "key": key})
+	if err == nil && s.signed {
+		msg, err = s.sign(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Builds the server and its routes
+func newServer(secret string) (*Server, http.Handler) {
+	s := &Server{
+		signer:   signature.NewSigner(signature.V1, signature.CLIENT_NAME, []string{secret}, 5*time.Minute),
+		received: make(chan struct{}, 1),
+		status:   http.StatusOK,
+		receipts: true,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.health)
+	mux.HandleFunc("/playlist/next", s.next)
+	mux.HandleFunc("/events/", s.event)
+	mux.HandleFunc("/", s.websocket)
+	return s, mux
+}
+
+// Starts a new fake Perceptor checking requests are signed with the secret
+func NewServer(secret string) *Server {
+	s, mux := newServer(secret)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// Starts a new fake Perceptor serving https and wss, see WriteCA
+func NewTLSServer(secret string) *Server {
+	s, mux := newServer(secret)
+	s.server = httptest.NewTLSServer(mux)
+	return s
+}
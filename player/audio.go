@@ -4,8 +4,11 @@
 package player
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"code.google.com/p/portaudio-go/portaudio"
 	"github.com/op/go-libspotify/spotify"
@@ -29,40 +32,48 @@ type audio struct {
 
 // audioWriter takes audio from libspotify and outputs it through PortAudio.
 type audioWriter struct {
-	input chan audio
-	quit  chan bool
-	wg    sync.WaitGroup
+	input  chan audio
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	last   int64 // unix nano time audio was last delivered, accessed atomically
+	vol    int32 // volume percentage, accessed atomically
+	fade   int32 // fade percentage applied on top of the volume, accessed atomically
 }
 
-// newAudioWriter creates a new audioWriter handler.
+// newAudioWriter creates a new audioWriter handler, writing until the
+// writer is closed.
 func newAudioWriter() (*audioWriter, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	w := &audioWriter{
-		input: make(chan audio, audioInputBufferSize),
-		quit:  make(chan bool, 1),
+		input:  make(chan audio, audioInputBufferSize),
+		cancel: cancel,
+		vol:    100,
+		fade:   100,
 	}
 
 	stream, err := newPortAudioStream()
 	if err != nil {
+		cancel()
 		return w, err
 	}
 
 	w.wg.Add(1)
-	go w.streamWriter(stream)
+	go w.streamWriter(ctx, stream)
 	return w, nil
 }
 
 // Close stops and closes the audio stream and terminates PortAudio.
 func (w *audioWriter) Close() error {
-	select {
-	case w.quit <- true:
-	default:
-	}
+	w.cancel()
 	w.wg.Wait()
 	return nil
 }
 
 // WriteAudio implements the spotify.AudioWriter interface.
 func (w *audioWriter) WriteAudio(format spotify.AudioFormat, frames []byte) int {
+	if len(frames) > 0 {
+		atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	}
 	select {
 	case w.input <- audio{format, frames}:
 		return len(frames)
@@ -71,9 +82,45 @@ func (w *audioWriter) WriteAudio(format spotify.AudioFormat, frames []byte) int
 	}
 }
 
+// lastWrite returns the time libspotify last delivered audio to the writer.
+func (w *audioWriter) lastWrite() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&w.last))
+}
+
+// setVolume sets the volume percentage audio is output at.
+func (w *audioWriter) setVolume(vol int) {
+	atomic.StoreInt32(&w.vol, int32(vol))
+}
+
+// fadeOut lowers the output to silence over the duration, blocking until it
+// is silent or the context is done.
+func (w *audioWriter) fadeOut(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		atomic.StoreInt32(&w.fade, 0)
+		return
+	}
+	steps := int32(20)
+	ticker := time.NewTicker(d / time.Duration(steps))
+	defer ticker.Stop()
+	for i := steps - 1; i >= 0; i-- {
+		select {
+		case <-ticker.C:
+			atomic.StoreInt32(&w.fade, 100*i/steps)
+		case <-ctx.Done():
+			atomic.StoreInt32(&w.fade, 0)
+			return
+		}
+	}
+}
+
+// resetFade restores the output after a fade out.
+func (w *audioWriter) resetFade() {
+	atomic.StoreInt32(&w.fade, 100)
+}
+
 // streamWriter reads data from the input buffer and writes it to the output
 // portaudio buffer.
-func (w *audioWriter) streamWriter(stream *portAudioStream) {
+func (w *audioWriter) streamWriter(ctx context.Context, stream *portAudioStream) {
 	defer w.wg.Done()
 	defer stream.Close()
 
@@ -85,7 +132,7 @@ func (w *audioWriter) streamWriter(stream *portAudioStream) {
 		var input audio
 		select {
 		case input = <-w.input:
-		case <-w.quit:
+		case <-ctx.Done():
 			return
 		}
 
@@ -96,12 +143,15 @@ func (w *audioWriter) streamWriter(stream *portAudioStream) {
 		}
 
 		// Decode the incoming data which is expected to be 2 channels and
-		// delivered as int16 in []byte, hence we need to convert it.
+		// delivered as int16 in []byte, hence we need to convert it. Samples
+		// are scaled to the current volume and fade.
+		vol := atomic.LoadInt32(&w.vol) * atomic.LoadInt32(&w.fade) / 100
 		i := 0
 		for i < len(input.frames) {
 			j := 0
 			for j < len(buffer) && i < len(input.frames) {
-				buffer[j] = int16(input.frames[i]) | int16(input.frames[i+1])<<8
+				sample := int16(input.frames[i]) | int16(input.frames[i+1])<<8
+				buffer[j] = int16(int32(sample) * vol / 100)
 				j += 1
 				i += 2
 			}
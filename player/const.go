@@ -12,3 +12,11 @@ const (
 	SETTINGS_LOCATION string          = "/tmp/soundwave"
 	BITRATE           spotify.Bitrate = spotify.Bitrate320k
 )
+
+// Stages at which a track can fail, reported to Perceptor
+const (
+	PARSE_STAGE       string = "parse"       // Spotify URI could not be parsed
+	LOAD_STAGE        string = "load"        // Track metadata failed to load
+	UNAVAILABLE_STAGE string = "unavailable" // Track is not playable
+	PLAYBACK_STAGE    string = "playback"    // Track could not be played
+)
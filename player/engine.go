@@ -0,0 +1,35 @@
+// Interfaces the player plays through
+
+package player
+
+import (
+	"context"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// Loads and plays audio for tracks, implemented by libspotify. Replacing
+// the engine allows the player to be driven without Spotify.
+type Engine interface {
+	Load(uri string) error                        // Load a track ready to play, returns a *TrackError on failure
+	Play()                                        // Play or resume the loaded track, does not block
+	Pause()                                       // Pause the loaded track
+	Unload()                                      // Unload the loaded track
+	EndOfTrack() <-chan struct{}                  // Receives when the loaded track ends
+	LastWrite() time.Time                         // Time audio was last delivered
+	SetVolume(vol int)                            // Set the output volume percentage
+	FadeOut(ctx context.Context, d time.Duration) // Fade the loaded track to silence and pause it, blocks until faded
+	Close() error                                 // Release the audio device and end the session
+}
+
+// Where a track came from and where its player events are sent, satisfied
+// by perceptor.Client and the fallback playlist
+type Source interface {
+	Next() (*perceptor.Track, error)
+	Play(t *perceptor.Track, start time.Time)
+	Pause(start time.Time)
+	Resume(duration int64)
+	End(t *perceptor.Track)
+	Error(t *perceptor.Track, stage string, message string)
+}
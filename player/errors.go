@@ -0,0 +1,47 @@
+// Player Errors
+
+package player
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons a track is not available for playback
+var (
+	ErrTrackUnavailable    = errors.New("track is not available in this region")
+	ErrTrackNotStreamable  = errors.New("track is not streamable")
+	ErrTrackBannedByArtist = errors.New("track is banned by the artist")
+	ErrTrackLocal          = errors.New("track is a local file")
+)
+
+// Returned when an event names a track that is no longer current
+var ErrStaleTrack = errors.New("track is no longer playing")
+
+// Returned for added tracks whilst adds are locked
+var ErrAddsLocked = errors.New("not accepting tracks right now")
+
+// Reasons a track was abandoned
+var (
+	ErrParseTimeout    = errors.New("timed out parsing track")
+	ErrLoadTimeout     = errors.New("timed out loading track")
+	ErrPlaybackStalled = errors.New("no audio delivered, playback stalled")
+)
+
+// Describes why and where a track failed to play
+type TrackError struct {
+	Stage string // Stage the track failed at, one of the *_STAGE constants
+	Err   error  // Underlying error
+}
+
+func (e *TrackError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+}
+
+// Wraps an error as a TrackError for the given stage
+func newTrackError(stage string, err error) *TrackError {
+	return &TrackError{
+		Stage: stage,
+		Err:   err,
+	}
+}
@@ -0,0 +1,70 @@
+// Fallback Playlist
+
+package player
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// Returned when there is no fallback playlist
+var ErrNoFallback = errors.New("no fallback playlist")
+
+// User fallback tracks are played for
+const FALLBACK_USER string = "fallback"
+
+// Plays a playlist on repeat when Perceptor has nothing to play. Fallback
+// tracks are not Perceptors, so events for them are only logged.
+type fallback struct {
+	lock   sync.Mutex
+	tracks []*perceptor.Track
+	next   int
+}
+
+// Replaces the playlist, an empty playlist clears it
+func (f *fallback) set(uris []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tracks = nil
+	f.next = 0
+	for _, uri := range uris {
+		f.tracks = append(f.tracks, &perceptor.Track{Uri: uri, User: FALLBACK_USER})
+	}
+}
+
+// Returns the next track in the playlist, starting again from the top once
+// the end is reached
+func (f *fallback) Next() (*perceptor.Track, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.tracks) == 0 {
+		return nil, ErrNoFallback
+	}
+	t := f.tracks[f.next%len(f.tracks)]
+	f.next = (f.next + 1) % len(f.tracks)
+	return t, nil
+}
+
+func (f *fallback) Play(t *perceptor.Track, start time.Time) {
+	log.Infof("Fallback: Playing %s", t.Uri)
+}
+
+func (f *fallback) Pause(start time.Time) {
+	log.Info("Fallback: Paused")
+}
+
+func (f *fallback) Resume(duration int64) {
+	log.Info("Fallback: Resumed")
+}
+
+func (f *fallback) End(t *perceptor.Track) {
+	log.Infof("Fallback: Ended %s", t.Uri)
+}
+
+func (f *fallback) Error(t *perceptor.Track, stage string, message string) {
+	log.Errorf("Fallback: Failed %s at %s: %s", t.Uri, stage, message)
+}
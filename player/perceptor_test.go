@@ -0,0 +1,63 @@
+package player
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+	"github.com/thisissoon/FM-SoundWave/perceptortest"
+)
+
+// Plays a track added on the fake Perceptor through to its end
+func TestPerceptorPlayLoop(t *testing.T) {
+	server := perceptortest.NewServer("secret")
+	defer server.Close()
+
+	bus := events.NewBus()
+	handler := events.NewHandler(bus)
+	pcptr := perceptor.New(server.Addr(), "secret", handler.ReceiveChannel(), bus)
+	handler.SetAcker(pcptr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handler.Run(ctx)
+	go pcptr.DeliverEvents(ctx)
+	go pcptr.WSConnection(ctx)
+
+	engine := newFakeEngine()
+	p := startPlayer(t, engine, pcptr, bus)
+
+	// Nothing to play until the track is added
+	server.Queue(&perceptor.Track{Id: "a", Uri: "spotify:track:a"})
+	add := []byte(`{"event": "add", "uri": "spotify:track:a"}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for err := server.Send(add); err != nil; err = server.Send(add) {
+		if time.Now().After(deadline) {
+			t.Fatalf("SoundWave did not connect: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e, err := server.WaitFor("play", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	play := &struct {
+		Uri string `json:"uri"`
+	}{}
+	if err := e.Decode(play); err != nil || play.Uri != "spotify:track:a" {
+		t.Errorf("got play %s", e.Body)
+	}
+	waitForTrack(t, p, "a")
+
+	engine.endTrack()
+	if _, err := server.WaitFor("end", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := server.Unsigned(); n != 0 {
+		t.Errorf("%d requests were not signed", n)
+	}
+}
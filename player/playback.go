@@ -0,0 +1,52 @@
+// Per Track Playback Lifecycle
+
+package player
+
+import (
+	"sync"
+
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// A single play of a track. Each track gets its own playback which is
+// cancelled when the track ends, is skipped or fails, so signals meant for
+// one track can never reach another.
+type playback struct {
+	track  *perceptor.Track
+	source Source        // Where the track came from and its events are sent
+	done   chan struct{} // Closed when the playback is cancelled
+	once   sync.Once
+	wg     sync.WaitGroup // Goroutines that must exit before the next track
+}
+
+// Constructs a new playback for the track from the source
+func newPlayback(t *perceptor.Track, source Source) *playback {
+	return &playback{
+		track:  t,
+		source: source,
+		done:   make(chan struct{}),
+	}
+}
+
+// Cancels the playback, safe to call many times
+func (pb *playback) cancel() {
+	pb.once.Do(func() {
+		close(pb.done)
+	})
+}
+
+// Runs f in a goroutine tied to the playback, f must return once the
+// playback is done
+func (pb *playback) goFunc(f func()) {
+	pb.wg.Add(1)
+	go func() {
+		defer pb.wg.Done()
+		f()
+	}()
+}
+
+// Cancels the playback and waits for its goroutines to exit
+func (pb *playback) close() {
+	pb.cancel()
+	pb.wg.Wait()
+}
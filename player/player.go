@@ -3,234 +3,471 @@
 package player
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/op/go-libspotify/spotify"
 	"github.com/thisissoon/FM-SoundWave/events"
 	"github.com/thisissoon/FM-SoundWave/perceptor"
 )
 
-// Vars for holding pause state
-var (
-	PAUSE_DURATION int64     = 0 // Total time we have been paused
-	PAUSE_START    time.Time     // Time time current pause was started
-)
-
 // Our Actual Spotify Player
 type Player struct {
-	audio    *audioWriter
-	session  *spotify.Session
-	player   *spotify.Player
-	pcptr    *perceptor.Perceptor
-	channels *events.Channels
+	engine   Engine
+	pcptr    perceptor.Client
+	next     chan bool // Signals there may be a next track
+	timeouts Timeouts
+	watchdog *watchdog
+	state    *stateMachine
+	lock     sync.Mutex
+	current  *playback              // Playback of the current track, nil when idle
+	fade     time.Duration          // How long to fade out the playing track for on shutdown
+	subs     []*events.Subscription // Event subscriptions, closed with the player
+	fallback *fallback              // Played when Perceptor has nothing to play
+	locked   bool                   // Added tracks are rejected whilst locked
+	held     bool                   // Held paused until resumed, tracks start paused
 }
 
-// Runs the player - plays the sweet sweet music
-func (p *Player) Run() {
-	for {
-		track, err := p.pcptr.Next()
+// Returns the current player state
+func (p *Player) State() State {
+	return p.state.current()
+}
+
+// Returns the player status sent to Perceptor in snapshots and heartbeats
+func (p *Player) Status() *perceptor.Status {
+	state, track, position := p.state.snapshot()
+	return &perceptor.Status{
+		State:    state.String(),
+		Track:    track,
+		Position: int64(position / time.Millisecond),
+	}
+}
+
+// Subscribes to player state changes. Changes are dropped rather than block
+// the player if the subscriber falls behind.
+func (p *Player) Subscribe() <-chan StateChange {
+	return p.state.subscribe()
+}
+
+// Calls f with every state change in order, for consumers that must not
+// miss any, e.g. webhooks. F is called from the player so must not block.
+func (p *Player) Observe(f func(StateChange)) {
+	p.state.observe(f)
+}
+
+// Stops sending state changes to the subscriber and closes its channel
+func (p *Player) Unsubscribe(c <-chan StateChange) {
+	p.state.unsubscribe(c)
+}
+
+// Runs the player - plays the sweet sweet music. Once the context is done
+// the playing track is faded out and reported as ended, then Run returns.
+func (p *Player) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		source, track, err := p.nextTrack()
 		if err != nil {
 			log.Infof("Failed to Get Track: %s", err)
-			<-p.channels.CheckNext // Block until we have a next track
+			// Block until we have a next track
+			select {
+			case <-p.next:
+			case <-ctx.Done():
+			}
 			continue
 		}
-		p.play(track)      // Blocks
-		p.pcptr.End(track) // Publish end event
+		p.state.fire(LOAD_TRIGGER, track)
+		// Play the track, blocks until the track ends, fails or we shutdown
+		if err := p.play(ctx, track, source); err != nil {
+			p.fail(source, track, err) // Publish error event
+		} else {
+			source.End(track) // Publish end event
+		}
+		p.state.fire(DONE_TRIGGER, nil)
 	}
+	log.Info("Player stopped")
 }
 
-// Handles recieving add events
-func (p *Player) addEventHandler() {
-	for {
-		<-p.channels.Add
-		log.Debug("Handle Add Event")
-		if len(p.channels.CheckNext) == 0 {
-			p.channels.CheckNext <- true
-		}
+// Sets how long the playing track is faded out for when the player stops
+func (p *Player) SetFadeOut(d time.Duration) {
+	p.fade = d
+}
+
+// Stops handling events and closes the engine, call once Run has returned
+func (p *Player) Close() error {
+	for _, sub := range p.subs {
+		sub.Close()
 	}
+	return p.engine.Close()
 }
 
-// Handles pause events
-func (p *Player) pauseEventHandler() {
-	for {
-		pause := <-p.channels.Pause
-		if pause {
-			log.Info("Pause Player")
-			PAUSE_START = time.Now().UTC()
-			go p.pcptr.Pause(PAUSE_START)
-			p.player.Pause()
-		} else {
-			log.Info("Resume Player")
-			now := time.Now().UTC()
-			delta := now.Sub(PAUSE_START)
-			paused_for := delta.Nanoseconds() / int64(time.Millisecond)
-			PAUSE_DURATION += paused_for
-			go p.pcptr.Resume(PAUSE_DURATION)
-			p.player.Play()
-		}
+// Returns the next track from Perceptor, or from the fallback playlist if
+// Perceptor has nothing to play, along with where it came from
+func (p *Player) nextTrack() (Source, *perceptor.Track, error) {
+	track, err := p.pcptr.Next()
+	if err == nil {
+		return p.pcptr, track, nil
 	}
+	if track, ferr := p.fallback.Next(); ferr == nil {
+		log.Infof("Failed to Get Track: %s, playing fallback", err)
+		return p.fallback, track, nil
+	}
+	return nil, nil, err
 }
 
-// Handle Skip events
-func (p *Player) skipEventHandler() {
-	for {
-		<-p.channels.Skip
-		log.Debug("Handle Skip Event")
-		p.channels.Stop <- true
+// Fails the track, reporting it to its source
+func (p *Player) fail(source Source, t *perceptor.Track, err error) {
+	stage := PLAYBACK_STAGE
+	if terr, ok := err.(*TrackError); ok {
+		stage = terr.Stage
+		err = terr.Err
+	}
+	p.state.fail(&Failure{Stage: stage, Message: err.Error()})
+	log.Errorf("Track failed at %s: %s: %s", stage, t.Uri, err)
+	source.Error(t, stage, err.Error())
+}
+
+// Handles recieving add events, and reconnections to Perceptor as tracks
+// may have been added whilst we were disconnected
+func (p *Player) addEventHandler(sub *events.Subscription) {
+	for e := range sub.Events() {
+		if c, ok := e.(*events.ConnectionEvent); ok && !c.Connected {
+			continue
+		}
+		log.Debugf("Handle %s Event", e.Header().Type)
+		if _, ok := e.(*events.AddEvent); ok && p.isLocked() {
+			log.Warnf("Add rejected: %s", ErrAddsLocked)
+			p.ack(e, ErrAddsLocked)
+			continue
+		}
+		p.state.fire(ADD_TRIGGER, nil)
+		p.wake()
+		p.ack(e, nil)
 	}
 }
 
-// Load Track from Spotify - Does not play it
-func (p *Player) loadTrack(uri string) (*spotify.Track, error) {
-	log.Infof("Load Track: %s", uri)
+// Handles scheduled lock and fallback events
+func (p *Player) scheduleEventHandler(sub *events.Subscription) {
+	for e := range sub.Events() {
+		switch e := e.(type) {
+		case *events.LockEvent:
+			log.Infof("Adds Locked: %v", e.Locked)
+			p.lock.Lock()
+			p.locked = e.Locked
+			p.lock.Unlock()
+		case *events.FallbackEvent:
+			log.Infof("Fallback Playlist: %d tracks", len(e.Playlist))
+			p.fallback.set(e.Playlist)
+			// Wake the player, it may be waiting for a track
+			if len(e.Playlist) > 0 {
+				p.wake()
+			}
+		}
+		p.ack(e, nil)
+	}
+}
 
-	// ParsePrintln the track URI
-	log.Debug("Parse link:", uri)
-	link, err := p.session.ParseLink(uri)
-	if err != nil {
-		return nil, err
+// Signals there may be a next track, without blocking if the player has
+// already been signalled
+func (p *Player) wake() {
+	select {
+	case p.next <- true:
+	default:
 	}
+}
 
-	// Get track link
-	log.Debug("Get Track Link")
-	track, err := link.Track()
-	if err != nil {
-		return nil, err
+// Returns true if added tracks are being rejected
+func (p *Player) isLocked() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.locked
+}
+
+// Returns the source of the current track, Perceptor when idle
+func (p *Player) source() Source {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.current == nil {
+		return p.pcptr
 	}
+	return p.current.source
+}
 
-	// Block until the track is loaded
-	log.Debug("Wait for Track")
-	track.Wait()
+// Acknowledges the event to its sender with the resulting player state
+func (p *Player) ack(e events.Event, err error) {
+	e.Header().Ack(err, p.State().String())
+}
 
-	return track, nil
+// Handles pause and resume events
+func (p *Player) pauseEventHandler(sub *events.Subscription) {
+	for e := range sub.Events() {
+		switch e := e.(type) {
+		case *events.PauseEvent:
+			p.ack(e, p.hold(e.Hold))
+		case *events.ResumeEvent:
+			p.ack(e, p.resume())
+		}
+	}
 }
 
-// Play a track until the end or we get message on the StopTrack channel
-func (p *Player) play(t *perceptor.Track) error {
-	// Reset Pause State
-	PAUSE_DURATION = 0
-	PAUSE_START = time.Time{}
+// Handles volume events
+func (p *Player) volumeEventHandler(sub *events.Subscription) {
+	for e := range sub.Events() {
+		v := e.(*events.VolumeEvent)
+		log.Infof("Set Volume: %d%%", v.Volume)
+		p.engine.SetVolume(v.Volume)
+		p.ack(e, nil)
+	}
+}
 
-	// Get the track
-	track, err := p.loadTrack(t.Uri)
+// Pauses the playing track
+func (p *Player) pause() error {
+	_, err := p.state.fireAndReport(PAUSE_TRIGGER, nil, func(change StateChange) {
+		p.source().Pause(change.Time)
+	})
 	if err != nil {
+		log.Warnf("Pause rejected: %s", err)
 		return err
 	}
+	log.Info("Pause Player")
+	p.watchdog.pause()
+	p.engine.Pause()
+	return nil
+}
 
-	// Load the Track
-	log.Info("Load Track into Player")
-	if err := p.player.Load(track); err != nil {
-		return err
+// Pauses the playing track, holding the player paused if hold is set so
+// tracks that start before the next resume start paused. A held pause is
+// accepted when nothing is playing.
+func (p *Player) hold(hold bool) error {
+	if hold {
+		log.Info("Hold Player Paused")
+		p.lock.Lock()
+		p.held = true
+		p.lock.Unlock()
+		if p.state.current() != PLAYING_STATE {
+			return nil
+		}
 	}
+	return p.pause()
+}
 
-	// Defer unloading the track until we exit this func
-	defer p.player.Unload()
-
-	// Send play event to perspector - go routine so we don't block
-	go func() {
-		p.pcptr.Play(t, time.Now().UTC())
-		return
-	}()
+// Returns true if the player is held paused
+func (p *Player) isHeld() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.held
+}
 
-	// Play the track
-	log.Println(fmt.Sprintf("Playing: %s", t.Uri))
-	p.player.Play() // This does NOT block, we must block ourselves
+// Resumes the paused track, releasing the player if it is held paused
+func (p *Player) resume() error {
+	p.lock.Lock()
+	held := p.held
+	p.held = false
+	p.lock.Unlock()
+	_, err := p.state.fireAndReport(RESUME_TRIGGER, nil, func(change StateChange) {
+		// The state lock is held, so the pause total can be read directly
+		p.source().Resume(int64(p.state.pausedFor / time.Millisecond))
+	})
+	if err != nil {
+		if held {
+			return nil
+		}
+		log.Warnf("Resume rejected: %s", err)
+		return err
+	}
+	log.Info("Resume Player")
+	p.watchdog.reset()
+	p.engine.Play()
+	return nil
+}
 
-	// Go routine to listen for end of track updates from the player, once we get one
-	// send a message to our own StopTrack channel
-	go func() {
-		<-p.session.EndOfTrackUpdates() // Blocks
-		log.Debug("End of Track Updates")
-		p.channels.Stop <- true
-		return
-	}()
+// Handle Skip events
+func (p *Player) skipEventHandler(sub *events.Subscription) {
+	for e := range sub.Events() {
+		log.Debug("Handle Skip Event")
+		// Only skip the track that was playing when the skip was sent
+		change, err := p.state.fireFor(SKIP_TRIGGER, e.(*events.StopEvent).Track)
+		if err != nil {
+			log.Warnf("Skip rejected: %s", err)
+			p.ack(e, err)
+			continue
+		}
+		p.cancel(change.Track)
+		p.ack(e, nil)
+	}
+}
 
-	<-p.channels.Stop // Blocks
-	log.Infof(fmt.Sprintf("Track stopped: %s", t.Uri))
+// Cancels the playback of the track if it is still the current track, a
+// track that is still loading will see it has been cancelled once loaded
+func (p *Player) cancel(t *perceptor.Track) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.current != nil && p.current.track == t {
+		p.current.cancel()
+	}
+}
 
-	return nil
+// Starts a new playback for the track, making it the current playback
+func (p *Player) begin(t *perceptor.Track, source Source) *playback {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current = newPlayback(t, source)
+	return p.current
 }
 
-// Constructs a new Spotify Player instance
-func New(
-	user string,
-	pass string,
-	keyPath string,
-	pcptr *perceptor.Perceptor,
-	channels *events.Channels) (*Player, error) {
+// Closes the playback, waiting for its goroutines to exit before clearing
+// the current playback
+func (p *Player) finish(pb *playback) {
+	pb.close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.current == pb {
+		p.current = nil
+	}
+}
 
-	var err error
+// Play a track until the end, it is skipped, it fails or the context is done
+func (p *Player) play(ctx context.Context, t *perceptor.Track, source Source) error {
+	pb := p.begin(t, source)
+	defer p.finish(pb)
 
-	// Create a new Audio Writer, this will be used to write the audio steeam to
-	log.Debug("Spotify: Create Audio Writter")
-	audio, err := newAudioWriter()
-	if err != nil {
-		return nil, err // Exit on fail
+	// Load the track
+	if err := p.engine.Load(t.Uri); err != nil {
+		return err
 	}
 
-	// Read Key File
-	log.Debug("Spotify: Read Key")
-	key, err := ioutil.ReadFile(keyPath)
+	// Defer unloading the track until we exit this func, deferred after
+	// finish so the track is unloaded before the playback is closed
+	defer p.engine.Unload()
+	p.drainEndOfTrack()
+
+	// The track may have been skipped whilst it was loading. The play
+	// event is queued for perspector without blocking as the track starts,
+	// so it is always sent before the track's pause, resume and end.
+	_, err := p.state.fireAndReport(PLAY_TRIGGER, nil, func(change StateChange) {
+		source.Play(t, change.Time)
+	})
 	if err != nil {
-		return nil, err // Exit on fail
+		log.Infof("Track skipped before playing: %s", t.Uri)
+		return nil
 	}
 
-	// Spotify Credentials
-	log.Debug("Spotify: Create Credentials")
-	creds := spotify.Credentials{
-		Username: user,
-		Password: pass,
+	// Play the track, tracks starting whilst the player is held paused
+	// start paused
+	log.Println(fmt.Sprintf("Playing: %s", t.Uri))
+	p.watchdog.reset()
+	if !p.isHeld() || p.pause() != nil {
+		p.engine.Play() // This does NOT block, we must block ourselves
 	}
 
-	// Make a ASession
-	log.Debug("Spotify: Create Session")
-	session, err := spotify.NewSession(&spotify.Config{
-		ApplicationKey:   key,
-		ApplicationName:  APPLICATION_NAME,
-		CacheLocation:    CACHE_LOCATION,
-		SettingsLocation: SETTINGS_LOCATION,
-		AudioConsumer:    audio,
-
-		// Disable playlists to make playback faster
-		DisablePlaylistMetadataCache: true,
-		InitiallyUnloadPlaylists:     true,
+	// Listen for end of track updates from the player for this playback only,
+	// exiting once the playback is done
+	pb.goFunc(func() {
+		select {
+		case <-p.engine.EndOfTrack():
+			log.Debug("End of Track Updates")
+			if _, err := p.state.fire(END_TRIGGER, nil); err == nil {
+				pb.cancel()
+			}
+		case <-pb.done:
+		}
 	})
-	if err != nil {
-		return nil, err // Exit on fail
+
+	// Block until the track is stopped, abandoning it if playback stalls
+	ticker := time.NewTicker(watchdogInterval(p.timeouts.Stall))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pb.done:
+			log.Infof(fmt.Sprintf("Track stopped: %s", t.Uri))
+			return nil
+		case <-ctx.Done():
+			return p.stop(t)
+		case <-ticker.C:
+			if p.watchdog.stalled() {
+				return newTrackError(PLAYBACK_STAGE, ErrPlaybackStalled)
+			}
+		}
 	}
+}
 
-	// Log Session Events
-	go func() {
-		for msg := range session.LogMessages() {
-			log.Debugf("Session: %s", msg)
+// Discards end of track updates that were not consumed by the playback they
+// belonged to, so they can not end the next track
+func (p *Player) drainEndOfTrack() {
+	for {
+		select {
+		case <-p.engine.EndOfTrack():
+			log.Debug("Discarded stale End of Track Update")
+		default:
+			return
 		}
-	}()
+	}
+}
 
-	// Set Bitrate (320kpbs)
-	log.Debugf("Spotify: Set Preferred Bitrate")
-	session.PreferredBitrate(BITRATE)
+// Fades out and stops the track on shutdown, giving up on the fade if it
+// outlasts the fade duration
+func (p *Player) stop(t *perceptor.Track) error {
+	log.Infof("Stopping: %s", t.Uri)
+	if p.state.current() == PLAYING_STATE {
+		ctx, cancel := context.WithTimeout(context.Background(), p.fade+time.Second)
+		p.engine.FadeOut(ctx, p.fade)
+		cancel()
+	}
+	p.state.fire(SKIP_TRIGGER, nil)
+	return nil
+}
+
+// Constructs a new Spotify Player instance
+func New(
+	user string,
+	pass string,
+	keyPath string,
+	timeouts Timeouts,
+	pcptr perceptor.Client,
+	bus *events.Bus) (*Player, error) {
 
-	// Login
-	if err = session.Login(creds, true); err != nil {
+	engine, err := newSpotifyEngine(user, pass, keyPath, timeouts)
+	if err != nil {
 		return nil, err // Exit on fail
 	}
 
+	return NewWithEngine(engine, timeouts, pcptr, bus), nil
+}
+
+// Constructs a new Player playing through the given engine
+func NewWithEngine(engine Engine, timeouts Timeouts, pcptr perceptor.Client, bus *events.Bus) *Player {
 	// Make the player
 	player := &Player{
-		audio:    audio,
-		session:  session,
+		engine:   engine,
 		pcptr:    pcptr,
-		channels: channels,
-		player:   session.Player(),
+		next:     make(chan bool, 1),
+		timeouts: timeouts,
+		watchdog: &watchdog{
+			timeout: timeouts.Stall,
+			engine:  engine,
+		},
+		state:    &stateMachine{},
+		fallback: &fallback{},
 	}
 
 	// Start our event handlers
-	go player.addEventHandler()
-	go player.pauseEventHandler()
-	go player.skipEventHandler()
+	player.subs = []*events.Subscription{
+		bus.Subscribe("player.add", 8, events.BLOCK_POLICY,
+			events.ADD_EVENT, events.CONNECTION_EVENT),
+		bus.Subscribe("player.pause", 8, events.BLOCK_POLICY,
+			events.PAUSE_EVENT, events.RESUME_EVENT),
+		bus.Subscribe("player.skip", 8, events.BLOCK_POLICY,
+			events.STOP_EVENT),
+		bus.Subscribe("player.volume", 8, events.BLOCK_POLICY,
+			events.VOLUME_EVENT),
+		bus.Subscribe("player.schedule", 8, events.BLOCK_POLICY,
+			events.LOCK_EVENT, events.FALLBACK_EVENT),
+	}
+	go player.addEventHandler(player.subs[0])
+	go player.pauseEventHandler(player.subs[1])
+	go player.skipEventHandler(player.subs[2])
+	go player.volumeEventHandler(player.subs[3])
+	go player.scheduleEventHandler(player.subs[4])
 
-	return player, nil
+	return player
 }
@@ -0,0 +1,313 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// Engine that plays tracks until told they have ended
+type fakeEngine struct {
+	lock   sync.Mutex
+	loaded string
+	end    chan struct{}    // Buffered like libspotify's end of track updates
+	onLoad func(uri string) // Called as each track loads
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{end: make(chan struct{}, 1)}
+}
+
+func (e *fakeEngine) Load(uri string) error {
+	if e.onLoad != nil {
+		e.onLoad(uri)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.loaded = uri
+	return nil
+}
+
+func (e *fakeEngine) Play()                                        {}
+func (e *fakeEngine) Pause()                                       {}
+func (e *fakeEngine) Unload()                                      {}
+func (e *fakeEngine) EndOfTrack() <-chan struct{}                  { return e.end }
+func (e *fakeEngine) LastWrite() time.Time                         { return time.Now() }
+func (e *fakeEngine) SetVolume(vol int)                            {}
+func (e *fakeEngine) FadeOut(ctx context.Context, d time.Duration) {}
+func (e *fakeEngine) Close() error                                 { return nil }
+
+// Sends an end of track update, as libspotify does when a track finishes
+func (e *fakeEngine) endTrack() {
+	select {
+	case e.end <- struct{}{}:
+	default:
+	}
+}
+
+// Source serving a fixed playlist and recording the events it is sent
+type fakeSource struct {
+	lock   sync.Mutex
+	tracks []*perceptor.Track
+	events []string
+}
+
+func newFakeSource(ids ...string) *fakeSource {
+	s := &fakeSource{}
+	for _, id := range ids {
+		s.tracks = append(s.tracks, &perceptor.Track{Id: id, Uri: "spotify:track:" + id})
+	}
+	return s
+}
+
+func (s *fakeSource) record(event string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Returns the events recorded with the prefix, e.g. "end "
+func (s *fakeSource) recorded(prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var events []string
+	for _, e := range s.events {
+		if len(e) >= len(prefix) && e[:len(prefix)] == prefix {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (s *fakeSource) Next() (*perceptor.Track, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tracks) == 0 {
+		return nil, errors.New("playlist is empty")
+	}
+	t := s.tracks[0]
+	s.tracks = s.tracks[1:]
+	return t, nil
+}
+
+func (s *fakeSource) Play(t *perceptor.Track, start time.Time) { s.record("play " + t.Id) }
+func (s *fakeSource) Pause(start time.Time)                    { s.record("pause") }
+func (s *fakeSource) Resume(duration int64)                    { s.record("resume") }
+func (s *fakeSource) End(t *perceptor.Track)                   { s.record("end " + t.Id) }
+func (s *fakeSource) Error(t *perceptor.Track, stage string, message string) {
+	s.record("error " + t.Id)
+}
+func (s *fakeSource) WSConnection(ctx context.Context) {}
+
+// Starts a player for the source, stopped when the test ends
+func startPlayer(t *testing.T, engine Engine, source perceptor.Client, bus *events.Bus) *Player {
+	p := NewWithEngine(engine, Timeouts{}, source, bus)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+		p.Close()
+	})
+	return p
+}
+
+// Waits for the player to be playing the track
+func waitForTrack(t *testing.T, p *Player, id string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		status := p.Status()
+		if status.State == PLAYING_STATE.String() && status.Track != nil && status.Track.Id == id {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("track %s not playing, status %+v", id, p.Status())
+}
+
+// Publishes a skip for the track, any track if the id is empty
+func skip(bus *events.Bus, id string) {
+	bus.Publish(&events.StopEvent{
+		Base:  events.Base{Type: events.STOP_EVENT, Timestamp: time.Now()},
+		Track: id,
+	})
+}
+
+func TestSkipBurst(t *testing.T) {
+	bus := events.NewBus()
+	source := newFakeSource("a", "b", "c", "d", "e")
+	p := startPlayer(t, newFakeEngine(), source, bus)
+	changes := p.Subscribe()
+	waitForTrack(t, p, "a")
+
+	skip(bus, "")
+	skip(bus, "")
+	skip(bus, "")
+
+	// Wait for the player to settle on the next track
+	deadline := time.After(2 * time.Second)
+	skipped := 0
+	for settled := false; !settled; {
+		select {
+		case change := <-changes:
+			if change.Trigger == SKIP_TRIGGER {
+				skipped++
+			}
+		case <-time.After(100 * time.Millisecond):
+			settled = p.State() == PLAYING_STATE
+		case <-deadline:
+			t.Fatalf("player did not settle, status %+v", p.Status())
+		}
+	}
+
+	ids := []string{"a", "b", "c", "d"}
+	if skipped < 1 || skipped > 3 {
+		t.Fatalf("%d skips applied", skipped)
+	}
+	var want []string
+	for _, id := range ids[:skipped] {
+		want = append(want, "end "+id)
+	}
+	if got := source.recorded("end "); !reflect.DeepEqual(got, want) {
+		t.Errorf("%d skips ended %v, want %v", skipped, got, want)
+	}
+	waitForTrack(t, p, ids[skipped])
+}
+
+func TestFastSkips(t *testing.T) {
+	bus := events.NewBus()
+	source := newFakeSource("a", "b", "c", "d")
+	p := startPlayer(t, newFakeEngine(), source, bus)
+
+	for _, id := range []string{"a", "b", "c"} {
+		waitForTrack(t, p, id)
+		skip(bus, id)
+	}
+	waitForTrack(t, p, "d")
+
+	want := []string{"end a", "end b", "end c"}
+	if got := source.recorded("end "); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStaleEndOfTrack(t *testing.T) {
+	bus := events.NewBus()
+	engine := newFakeEngine()
+	// libspotify can deliver the end of the skipped track after the skip
+	engine.onLoad = func(uri string) {
+		if uri == "spotify:track:b" {
+			engine.endTrack()
+		}
+	}
+	source := newFakeSource("a", "b", "c")
+	p := startPlayer(t, engine, source, bus)
+
+	waitForTrack(t, p, "a")
+	skip(bus, "a")
+	waitForTrack(t, p, "b")
+
+	time.Sleep(100 * time.Millisecond)
+	waitForTrack(t, p, "b")
+	if got := source.recorded("end "); !reflect.DeepEqual(got, []string{"end a"}) {
+		t.Fatalf("stale end of track ended the next track: %v", got)
+	}
+
+	// A real end of track still ends it
+	engine.endTrack()
+	waitForTrack(t, p, "c")
+	if got := source.recorded("end "); !reflect.DeepEqual(got, []string{"end a", "end b"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	bus := events.NewBus()
+	engine := newFakeEngine()
+	source := newFakeSource("a", "b", "c", "d")
+	p := startPlayer(t, engine, source, bus)
+	changes := p.Subscribe()
+
+	var want []string
+	for _, id := range []string{"a", "b", "c"} {
+		waitForTrack(t, p, id)
+		// Sent back to back, as fast as the player handles them
+		bus.Publish(&events.PauseEvent{Base: events.Base{Type: events.PAUSE_EVENT, Timestamp: time.Now()}})
+		bus.Publish(&events.ResumeEvent{Base: events.Base{Type: events.RESUME_EVENT, Timestamp: time.Now()}})
+		for change := range changes {
+			if change.Trigger == RESUME_TRIGGER {
+				break
+			}
+		}
+		engine.endTrack()
+		want = append(want, "play "+id, "pause", "resume", "end "+id)
+	}
+	waitForTrack(t, p, "d")
+
+	if got := source.recorded(""); !reflect.DeepEqual(got, append(want, "play d")) {
+		t.Errorf("got %v, want %v", got, append(want, "play d"))
+	}
+}
+
+func TestHeldPause(t *testing.T) {
+	bus := events.NewBus()
+	engine := newFakeEngine()
+	source := newFakeSource("a", "b")
+	p := startPlayer(t, engine, source, bus)
+	waitForTrack(t, p, "a")
+
+	// Held whilst playing pauses the track, the next track starts paused
+	if err := p.hold(true); err != nil {
+		t.Fatal(err)
+	}
+	if p.State() != PAUSED_STATE {
+		t.Fatalf("state %s, want paused", p.State())
+	}
+	skip(bus, "a")
+	deadline := time.Now().Add(2 * time.Second)
+	for status := p.Status(); status.Track == nil || status.Track.Id != "b" || p.State() != PAUSED_STATE; status = p.Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("next track did not start paused, status %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitForTrack(t, p, "b")
+	want := []string{"play a", "pause", "end a", "play b", "pause", "resume"}
+	if got := source.recorded(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHeldPauseWhilstIdle(t *testing.T) {
+	bus := events.NewBus()
+	source := newFakeSource()
+	p := startPlayer(t, newFakeEngine(), source, bus)
+
+	if err := p.hold(true); err != nil {
+		t.Errorf("held pause whilst idle: %s", err)
+	}
+	if err := p.hold(false); err == nil {
+		t.Error("pause whilst idle accepted")
+	}
+	if err := p.resume(); err != nil {
+		t.Errorf("resume of the held pause: %s", err)
+	}
+	if err := p.resume(); err == nil {
+		t.Error("resume whilst idle accepted")
+	}
+}
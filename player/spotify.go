@@ -0,0 +1,223 @@
+// Spotify Playback Engine
+
+package player
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/op/go-libspotify/spotify"
+)
+
+// Plays tracks through a libspotify session
+type spotifyEngine struct {
+	audio    *audioWriter
+	session  *spotify.Session
+	player   *spotify.Player
+	timeouts Timeouts
+}
+
+// Loads the track into the Spotify player, resolving the URI to a playable
+// track first
+func (e *spotifyEngine) Load(uri string) error {
+	track, err := e.loadTrack(uri)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Load Track into Player")
+	e.audio.resetFade()
+	if err := e.player.Load(track); err != nil {
+		return newTrackError(PLAYBACK_STAGE, err)
+	}
+
+	return nil
+}
+
+func (e *spotifyEngine) Play() {
+	e.player.Play()
+}
+
+func (e *spotifyEngine) Pause() {
+	e.player.Pause()
+}
+
+func (e *spotifyEngine) Unload() {
+	e.player.Unload()
+}
+
+func (e *spotifyEngine) EndOfTrack() <-chan struct{} {
+	return e.session.EndOfTrackUpdates()
+}
+
+func (e *spotifyEngine) LastWrite() time.Time {
+	return e.audio.lastWrite()
+}
+
+func (e *spotifyEngine) SetVolume(vol int) {
+	e.audio.setVolume(vol)
+}
+
+func (e *spotifyEngine) FadeOut(ctx context.Context, d time.Duration) {
+	e.audio.fadeOut(ctx, d)
+	e.player.Pause()
+}
+
+// Logs out and closes the session, then closes the audio writer which
+// terminates PortAudio
+func (e *spotifyEngine) Close() error {
+	log.Debug("Spotify: Logout")
+	if err := e.session.Logout(); err != nil {
+		log.Errorf("Spotify: Logout Error: %s", err)
+	}
+	log.Debug("Spotify: Close Session")
+	err := e.session.Close()
+	e.audio.Close()
+	return err
+}
+
+// Load Track from Spotify - Does not play it
+func (e *spotifyEngine) loadTrack(uri string) (*spotify.Track, error) {
+	log.Infof("Load Track: %s", uri)
+
+	// Parse the track URI and get the track from the link
+	log.Debug("Parse link:", uri)
+	var track *spotify.Track
+	err := withTimeout(e.timeouts.Parse, ErrParseTimeout, func() error {
+		link, err := e.session.ParseLink(uri)
+		if err != nil {
+			return err
+		}
+		log.Debug("Get Track Link")
+		track, err = link.Track()
+		return err
+	})
+	if err != nil {
+		return nil, newTrackError(PARSE_STAGE, err)
+	}
+
+	// Block until the track is loaded
+	log.Debug("Wait for Track")
+	if err := e.waitTrack(track); err != nil {
+		return nil, newTrackError(LOAD_STAGE, err)
+	}
+
+	// Make sure the track can be played, or find its replacement
+	log.Debug("Check Track Availability")
+	return e.availableTrack(track)
+}
+
+// Blocks until the track metadata is loaded or the load timeout expires
+func (e *spotifyEngine) waitTrack(track *spotify.Track) error {
+	return withTimeout(e.timeouts.Load, ErrLoadTimeout, func() error {
+		track.Wait()
+		return track.Error()
+	})
+}
+
+// Returns the track that should actually be played. Tracks that are not
+// available to us, for example region restricted ones, are replaced by the
+// track Spotify has linked to them when there is one
+func (e *spotifyEngine) availableTrack(track *spotify.Track) (*spotify.Track, error) {
+	if track.IsLocal() {
+		return nil, newTrackError(UNAVAILABLE_STAGE, ErrTrackLocal)
+	}
+
+	// Use the linked replacement track if Spotify has one
+	if track.IsAutoLinked() {
+		if linked := track.Playable(); linked != nil && e.waitTrack(linked) == nil {
+			if err := availability(linked); err == nil {
+				log.Infof("Playing linked track in place of: %s", track.Link())
+				return linked, nil
+			}
+		}
+	}
+
+	if err := availability(track); err != nil {
+		return nil, newTrackError(UNAVAILABLE_STAGE, err)
+	}
+
+	return track, nil
+}
+
+// Converts the libspotify availability of a track into an error
+func availability(track *spotify.Track) error {
+	switch track.Availability() {
+	case spotify.TrackAvailabilityAvailable:
+		return nil
+	case spotify.TrackAvailabilityNotStreamable:
+		return ErrTrackNotStreamable
+	case spotify.TrackAvailabilityBannedByArtist:
+		return ErrTrackBannedByArtist
+	default:
+		return ErrTrackUnavailable
+	}
+}
+
+// Creates a Spotify session and logs in
+func newSpotifyEngine(user string, pass string, keyPath string, timeouts Timeouts) (*spotifyEngine, error) {
+	var err error
+
+	// Create a new Audio Writer, this will be used to write the audio steeam to
+	log.Debug("Spotify: Create Audio Writter")
+	audio, err := newAudioWriter()
+	if err != nil {
+		return nil, err // Exit on fail
+	}
+
+	// Read Key File
+	log.Debug("Spotify: Read Key")
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err // Exit on fail
+	}
+
+	// Spotify Credentials
+	log.Debug("Spotify: Create Credentials")
+	creds := spotify.Credentials{
+		Username: user,
+		Password: pass,
+	}
+
+	// Make a ASession
+	log.Debug("Spotify: Create Session")
+	session, err := spotify.NewSession(&spotify.Config{
+		ApplicationKey:   key,
+		ApplicationName:  APPLICATION_NAME,
+		CacheLocation:    CACHE_LOCATION,
+		SettingsLocation: SETTINGS_LOCATION,
+		AudioConsumer:    audio,
+
+		// Disable playlists to make playback faster
+		DisablePlaylistMetadataCache: true,
+		InitiallyUnloadPlaylists:     true,
+	})
+	if err != nil {
+		return nil, err // Exit on fail
+	}
+
+	// Log Session Events
+	go func() {
+		for msg := range session.LogMessages() {
+			log.Debugf("Session: %s", msg)
+		}
+	}()
+
+	// Set Bitrate (320kpbs)
+	log.Debugf("Spotify: Set Preferred Bitrate")
+	session.PreferredBitrate(BITRATE)
+
+	// Login
+	if err = session.Login(creds, true); err != nil {
+		return nil, err // Exit on fail
+	}
+
+	return &spotifyEngine{
+		audio:    audio,
+		session:  session,
+		player:   session.Player(),
+		timeouts: timeouts,
+	}, nil
+}
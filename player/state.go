@@ -0,0 +1,352 @@
+// Player State Machine
+
+package player
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// States the player can be in
+type State int
+
+const (
+	IDLE_STATE     State = iota // Waiting for a track
+	LOADING_STATE               // Loading a track from Spotify
+	PLAYING_STATE               // Playing a track
+	PAUSED_STATE                // Playing track is paused
+	STOPPING_STATE              // Track has ended, been skipped or failed
+)
+
+func (s State) String() string {
+	switch s {
+	case IDLE_STATE:
+		return "idle"
+	case LOADING_STATE:
+		return "loading"
+	case PLAYING_STATE:
+		return "playing"
+	case PAUSED_STATE:
+		return "paused"
+	case STOPPING_STATE:
+		return "stopping"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for state := IDLE_STATE; state <= STOPPING_STATE; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state: %s", text)
+}
+
+// Triggers move the player between states
+type Trigger string
+
+const (
+	ADD_TRIGGER    Trigger = "add"    // Track added to the playlist
+	LOAD_TRIGGER   Trigger = "load"   // Started loading a track
+	PLAY_TRIGGER   Trigger = "play"   // Loaded track started playing
+	PAUSE_TRIGGER  Trigger = "pause"  // Pause the playing track
+	RESUME_TRIGGER Trigger = "resume" // Resume the paused track
+	SKIP_TRIGGER   Trigger = "skip"   // Skip the current track
+	END_TRIGGER    Trigger = "end"    // Track reached its end
+	FAIL_TRIGGER   Trigger = "fail"   // Track failed to load or play
+	DONE_TRIGGER   Trigger = "done"   // Track has been unloaded
+)
+
+// Valid transitions, any trigger not listed for a state is rejected
+var transitions = map[State]map[Trigger]State{
+	IDLE_STATE: {
+		ADD_TRIGGER:  IDLE_STATE,
+		LOAD_TRIGGER: LOADING_STATE,
+	},
+	LOADING_STATE: {
+		ADD_TRIGGER:  LOADING_STATE,
+		PLAY_TRIGGER: PLAYING_STATE,
+		SKIP_TRIGGER: STOPPING_STATE,
+		FAIL_TRIGGER: STOPPING_STATE,
+	},
+	PLAYING_STATE: {
+		ADD_TRIGGER:   PLAYING_STATE,
+		PAUSE_TRIGGER: PAUSED_STATE,
+		SKIP_TRIGGER:  STOPPING_STATE,
+		END_TRIGGER:   STOPPING_STATE,
+		FAIL_TRIGGER:  STOPPING_STATE,
+	},
+	PAUSED_STATE: {
+		ADD_TRIGGER:    PAUSED_STATE,
+		RESUME_TRIGGER: PLAYING_STATE,
+		SKIP_TRIGGER:   STOPPING_STATE,
+		FAIL_TRIGGER:   STOPPING_STATE,
+	},
+	STOPPING_STATE: {
+		ADD_TRIGGER:  STOPPING_STATE,
+		FAIL_TRIGGER: STOPPING_STATE,
+		DONE_TRIGGER: IDLE_STATE,
+	},
+}
+
+// Returned when a trigger is not valid in the current state
+type TransitionError struct {
+	State   State
+	Trigger Trigger
+}
+
+func (e *TransitionError) Error() string {
+	switch {
+	case e.State == IDLE_STATE:
+		return fmt.Sprintf("cannot %s: nothing playing", e.Trigger)
+	case e.State == e.next():
+		return fmt.Sprintf("cannot %s: already %s", e.Trigger, e.State)
+	}
+	return fmt.Sprintf("cannot %s while %s", e.Trigger, e.State)
+}
+
+// The state the trigger leads to from any state, used to spot repeated triggers
+func (e *TransitionError) next() State {
+	for _, t := range transitions {
+		if to, ok := t[e.Trigger]; ok {
+			return to
+		}
+	}
+	return e.State
+}
+
+// Why a track failed to play
+type Failure struct {
+	Stage   string `json:"stage"` // One of the *_STAGE constants
+	Message string `json:"message"`
+}
+
+// Describes a change in player state
+type StateChange struct {
+	From    State            `json:"from"`
+	To      State            `json:"to"`
+	Trigger Trigger          `json:"trigger"`
+	Track   *perceptor.Track `json:"track"` // Current track, nil when idle
+	Time    time.Time        `json:"time"`
+	Played  bool             `json:"played,omitempty"`  // Track started playing, set when it is done
+	Failure *Failure         `json:"failure,omitempty"` // Why the track failed, set when it is done
+}
+
+// Returns the player event the change represents, play, pause, resume, end
+// or error, or nil if the change is not one other services are told about.
+// Tracks stopped before they started playing are not reported as ended.
+func (c StateChange) Event() events.Event {
+	base := events.Base{Timestamp: c.Time}
+	if c.Track != nil {
+		base.User = c.Track.User
+	}
+	switch {
+	case c.From == LOADING_STATE && c.To == PLAYING_STATE:
+		base.Type = events.PLAY_EVENT
+		return &events.PlayEvent{Base: base, Track: c.Track.Id, Uri: c.Track.Uri}
+	case c.To == PAUSED_STATE:
+		base.Type = events.PAUSE_EVENT
+		return &events.PauseEvent{Base: base}
+	case c.From == PAUSED_STATE && c.To == PLAYING_STATE:
+		base.Type = events.RESUME_EVENT
+		return &events.ResumeEvent{Base: base}
+	case c.From == STOPPING_STATE && c.To == IDLE_STATE && c.Failure != nil:
+		base.Type = events.ERROR_EVENT
+		return &events.ErrorEvent{
+			Base:    base,
+			Track:   c.Track.Id,
+			Uri:     c.Track.Uri,
+			Stage:   c.Failure.Stage,
+			Message: c.Failure.Message,
+		}
+	case c.From == STOPPING_STATE && c.To == IDLE_STATE && c.Played:
+		base.Type = events.END_EVENT
+		return &events.EndEvent{Base: base, Track: c.Track.Id, Uri: c.Track.Uri}
+	}
+	return nil
+}
+
+// Size of each subscribers state change buffer
+var stateBufferSize = 16
+
+// Thread safe state machine holding the player state and the current track
+type stateMachine struct {
+	lock        sync.Mutex
+	state       State
+	track       *perceptor.Track
+	started     time.Time     // Time the current track started playing, zero until it does
+	failure     *Failure      // Why the current track failed
+	pauseStart  time.Time     // Time the current pause started
+	pausedFor   time.Duration // Total time the current track has been paused
+	subscribers []chan StateChange
+	observers   []func(StateChange)
+}
+
+// Returns the current state
+func (m *stateMachine) current() State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state
+}
+
+// Returns the current state and track, and how far through the track
+// playback is
+func (m *stateMachine) snapshot() (State, *perceptor.Track, time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var position time.Duration
+	switch m.state {
+	case PLAYING_STATE:
+		position = time.Since(m.started) - m.pausedFor
+	case PAUSED_STATE:
+		position = m.pauseStart.Sub(m.started) - m.pausedFor
+	}
+	return m.state, m.track, position
+}
+
+// Applies a trigger, moving to the next state or returning a TransitionError
+// if the trigger is not valid in the current state. Subscribers are notified
+// of any change in state. The track is only used by the load trigger.
+func (m *stateMachine) fire(trigger Trigger, track *perceptor.Track) (StateChange, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.apply(trigger, track)
+}
+
+// Applies a trigger like fire, calling report with the change before the
+// lock is released, so events reported for the change are always reported
+// before those of any later change. Report must not use the state machine.
+func (m *stateMachine) fireAndReport(trigger Trigger, track *perceptor.Track, report func(StateChange)) (StateChange, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	change, err := m.apply(trigger, track)
+	if err == nil {
+		report(change)
+	}
+	return change, err
+}
+
+// Applies a trigger only if the current track has the given id, so events
+// sent for a track that has since ended can not act on the next one. An
+// empty id matches any track.
+func (m *stateMachine) fireFor(trigger Trigger, id string) (StateChange, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if id != "" && m.track != nil && m.track.Id != id {
+		return StateChange{}, ErrStaleTrack
+	}
+	return m.apply(trigger, nil)
+}
+
+// Applies the fail trigger, recording why the track failed
+func (m *stateMachine) fail(f *Failure) (StateChange, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	change, err := m.apply(FAIL_TRIGGER, nil)
+	if err == nil {
+		m.failure = f
+	}
+	return change, err
+}
+
+// Applies a trigger, the lock must be held
+func (m *stateMachine) apply(trigger Trigger, track *perceptor.Track) (StateChange, error) {
+	to, ok := transitions[m.state][trigger]
+	if !ok {
+		return StateChange{}, &TransitionError{State: m.state, Trigger: trigger}
+	}
+
+	now := time.Now().UTC()
+	switch trigger {
+	case LOAD_TRIGGER:
+		m.track = track
+		m.started = time.Time{}
+		m.failure = nil
+		m.pauseStart = time.Time{}
+		m.pausedFor = 0
+	case PLAY_TRIGGER:
+		m.started = now
+	case PAUSE_TRIGGER:
+		m.pauseStart = now
+	case RESUME_TRIGGER:
+		m.pausedFor += now.Sub(m.pauseStart)
+	}
+
+	change := StateChange{
+		From:    m.state,
+		To:      to,
+		Trigger: trigger,
+		Track:   m.track,
+		Time:    now,
+	}
+	if trigger == DONE_TRIGGER {
+		change.Played = !m.started.IsZero()
+		change.Failure = m.failure
+		m.track = nil
+	}
+	m.state = to
+
+	if change.From != change.To {
+		log.Debugf("Player State: %s -> %s (%s)", change.From, change.To, trigger)
+		m.notify(change)
+	}
+
+	return change, nil
+}
+
+// Sends the change to all subscribers, dropping it for those that are full
+// so a slow subscriber can never block the player. Observers are called
+// with every change.
+func (m *stateMachine) notify(change StateChange) {
+	for _, f := range m.observers {
+		f(change)
+	}
+	for _, c := range m.subscribers {
+		select {
+		case c <- change:
+		default:
+			log.Warnf("State subscriber full, dropped: %s -> %s", change.From, change.To)
+		}
+	}
+}
+
+// Adds a subscriber
+func (m *stateMachine) subscribe() <-chan StateChange {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c := make(chan StateChange, stateBufferSize)
+	m.subscribers = append(m.subscribers, c)
+	return c
+}
+
+// Adds an observer, called with every change in order whilst the lock is
+// held, so it must return quickly and not use the state machine
+func (m *stateMachine) observe(f func(StateChange)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.observers = append(m.observers, f)
+}
+
+// Removes a subscriber, closing its channel
+func (m *stateMachine) unsubscribe(c <-chan StateChange) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, s := range m.subscribers {
+		if s == c {
+			m.subscribers = append(m.subscribers[:i], m.subscribers[i+1:]...)
+			close(s)
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package player
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+func TestTransitions(t *testing.T) {
+	for from, triggers := range transitions {
+		for trigger, to := range triggers {
+			m := &stateMachine{state: from, track: &perceptor.Track{Id: "a"}}
+			change, err := m.fire(trigger, &perceptor.Track{Id: "b"})
+			if err != nil {
+				t.Errorf("%s from %s: %s", trigger, from, err)
+				continue
+			}
+			if m.current() != to || change.From != from || change.To != to || change.Trigger != trigger {
+				t.Errorf("%s from %s: got %+v, state %s, want %s", trigger, from, change, m.current(), to)
+			}
+		}
+	}
+}
+
+func TestInvalidTriggers(t *testing.T) {
+	tests := []struct {
+		state   State
+		trigger Trigger
+		message string
+	}{
+		{IDLE_STATE, PAUSE_TRIGGER, "cannot pause: nothing playing"},
+		{IDLE_STATE, SKIP_TRIGGER, "cannot skip: nothing playing"},
+		{PAUSED_STATE, PAUSE_TRIGGER, "cannot pause: already paused"},
+		{PLAYING_STATE, RESUME_TRIGGER, "cannot resume: already playing"},
+		{PLAYING_STATE, LOAD_TRIGGER, "cannot load while playing"},
+		{LOADING_STATE, PAUSE_TRIGGER, "cannot pause while loading"},
+	}
+	for _, test := range tests {
+		m := &stateMachine{state: test.state}
+		_, err := m.fire(test.trigger, nil)
+		terr, ok := err.(*TransitionError)
+		if !ok {
+			t.Errorf("%s from %s: expected a TransitionError, got %v", test.trigger, test.state, err)
+			continue
+		}
+		if terr.State != test.state || terr.Trigger != test.trigger {
+			t.Errorf("%s from %s: got %+v", test.trigger, test.state, terr)
+		}
+		if terr.Error() != test.message {
+			t.Errorf("%s from %s: got %q, want %q", test.trigger, test.state, terr.Error(), test.message)
+		}
+		if m.current() != test.state {
+			t.Errorf("%s from %s: moved to %s", test.trigger, test.state, m.current())
+		}
+	}
+}
+
+func TestFireFor(t *testing.T) {
+	tests := []struct {
+		id  string
+		err error
+	}{
+		{"a", nil},
+		{"b", ErrStaleTrack},
+		{"", nil},
+	}
+	for _, test := range tests {
+		m := &stateMachine{state: PLAYING_STATE, track: &perceptor.Track{Id: "a"}}
+		_, err := m.fireFor(SKIP_TRIGGER, test.id)
+		if err != test.err {
+			t.Errorf("skip %q: got %v, want %v", test.id, err, test.err)
+		}
+		want := STOPPING_STATE
+		if test.err != nil {
+			want = PLAYING_STATE
+		}
+		if m.current() != want {
+			t.Errorf("skip %q: state %s, want %s", test.id, m.current(), want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	m := &stateMachine{}
+	c := m.subscribe()
+	track := &perceptor.Track{Id: "a"}
+	m.fire(LOAD_TRIGGER, track)
+	select {
+	case change := <-c:
+		if change.From != IDLE_STATE || change.To != LOADING_STATE || change.Track != track {
+			t.Errorf("got %+v", change)
+		}
+	default:
+		t.Fatal("no state change received")
+	}
+
+	// Triggers that do not change state are not sent
+	m.fire(ADD_TRIGGER, nil)
+	select {
+	case change := <-c:
+		t.Errorf("unexpected change %+v", change)
+	default:
+	}
+
+	m.unsubscribe(c)
+	if _, ok := <-c; ok {
+		t.Error("channel not closed")
+	}
+	m.fire(PLAY_TRIGGER, nil) // Must not send on the closed channel
+}
+
+func TestFullSubscriberDropped(t *testing.T) {
+	m := &stateMachine{}
+	full := m.subscribe()
+	other := m.subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= stateBufferSize; i++ {
+			m.fire(LOAD_TRIGGER, nil)
+			m.fire(FAIL_TRIGGER, nil)
+			m.fire(DONE_TRIGGER, nil)
+			<-other
+			<-other
+			<-other
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("full subscriber blocked the state machine")
+	}
+	if len(full) != stateBufferSize {
+		t.Errorf("got %d buffered changes, want %d", len(full), stateBufferSize)
+	}
+}
+
+func TestStopEvents(t *testing.T) {
+	track := &perceptor.Track{Id: "a", Uri: "spotify:track:a"}
+	tests := []struct {
+		name  string
+		run   func(m *stateMachine)
+		event string // Event sent when the track is done, empty for none
+	}{
+		{"ended", func(m *stateMachine) {
+			m.fire(PLAY_TRIGGER, nil)
+			m.fire(END_TRIGGER, nil)
+		}, events.END_EVENT},
+		{"skipped", func(m *stateMachine) {
+			m.fire(PLAY_TRIGGER, nil)
+			m.fire(SKIP_TRIGGER, nil)
+		}, events.END_EVENT},
+		{"skipped whilst loading", func(m *stateMachine) {
+			m.fire(SKIP_TRIGGER, nil)
+		}, ""},
+		{"failed whilst loading", func(m *stateMachine) {
+			m.fail(&Failure{Stage: LOAD_STAGE, Message: "timed out"})
+		}, events.ERROR_EVENT},
+		{"failed whilst playing", func(m *stateMachine) {
+			m.fire(PLAY_TRIGGER, nil)
+			m.fail(&Failure{Stage: PLAYBACK_STAGE, Message: "stalled"})
+		}, events.ERROR_EVENT},
+	}
+	for _, test := range tests {
+		m := &stateMachine{}
+		m.fire(LOAD_TRIGGER, track)
+		test.run(m)
+		change, err := m.fire(DONE_TRIGGER, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		e := change.Event()
+		switch {
+		case test.event == "" && e != nil:
+			t.Errorf("%s: unexpected %s event", test.name, e.Header().Type)
+		case test.event != "" && (e == nil || e.Header().Type != test.event):
+			t.Errorf("%s: got %v, want %s event", test.name, e, test.event)
+		}
+		if ee, ok := e.(*events.ErrorEvent); ok && (ee.Uri != track.Uri || ee.Stage == "" || ee.Message == "") {
+			t.Errorf("%s: got %+v", test.name, ee)
+		}
+	}
+
+	// A track that failed whilst loading does not carry over to the next
+	m := &stateMachine{}
+	m.fire(LOAD_TRIGGER, track)
+	m.fail(&Failure{Stage: LOAD_STAGE, Message: "timed out"})
+	m.fire(DONE_TRIGGER, nil)
+	m.fire(LOAD_TRIGGER, track)
+	m.fire(PLAY_TRIGGER, nil)
+	m.fire(END_TRIGGER, nil)
+	if change, _ := m.fire(DONE_TRIGGER, nil); change.Event().Header().Type != events.END_EVENT {
+		t.Errorf("got %s event after a failed track", change.Event().Header().Type)
+	}
+}
+
+func TestObserverGetsEveryChange(t *testing.T) {
+	m := &stateMachine{}
+	var changes []StateChange
+	m.observe(func(change StateChange) {
+		changes = append(changes, change)
+	})
+	// More changes than a subscriber buffers
+	for i := 0; i < stateBufferSize; i++ {
+		m.fire(LOAD_TRIGGER, nil)
+		m.fire(PLAY_TRIGGER, nil)
+		m.fire(END_TRIGGER, nil)
+		m.fire(DONE_TRIGGER, nil)
+	}
+	if len(changes) != 4*stateBufferSize {
+		t.Errorf("observed %d changes, want %d", len(changes), 4*stateBufferSize)
+	}
+}
+
+func TestReportedBeforeLaterChanges(t *testing.T) {
+	m := &stateMachine{}
+	m.fire(LOAD_TRIGGER, &perceptor.Track{Id: "a"})
+	m.fire(PLAY_TRIGGER, nil)
+
+	reporting := make(chan struct{})
+	reported := make(chan struct{})
+	go m.fireAndReport(PAUSE_TRIGGER, nil, func(change StateChange) {
+		close(reporting)
+		<-reported
+	})
+	<-reporting
+
+	// A skip racing the pause waits for the pause to be reported
+	skipped := make(chan struct{})
+	go func() {
+		m.fire(SKIP_TRIGGER, nil)
+		close(skipped)
+	}()
+	select {
+	case <-skipped:
+		t.Fatal("skip applied before the pause was reported")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(reported)
+	<-skipped
+
+	if _, err := m.fireAndReport(RESUME_TRIGGER, nil, func(StateChange) {
+		t.Error("rejected trigger reported")
+	}); err == nil {
+		t.Error("resume accepted whilst stopping")
+	}
+}
@@ -0,0 +1,80 @@
+// Playback Stall Watchdog
+
+package player
+
+import (
+	"sync"
+	"time"
+)
+
+// Timeouts for the stages of playing a track, zero disables the timeout
+type Timeouts struct {
+	Parse time.Duration // Parsing the URI into a track
+	Load  time.Duration // Waiting for track metadata to load
+	Stall time.Duration // No audio delivered while playing
+}
+
+// Watches the engine for playback that has stopped delivering audio
+type watchdog struct {
+	timeout time.Duration
+	engine  Engine
+	lock    sync.Mutex
+	paused  bool      // Paused tracks are never stalled
+	since   time.Time // Time the watchdog was last reset
+}
+
+// Resets the watchdog, called when playback starts or resumes
+func (w *watchdog) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.paused = false
+	w.since = time.Now()
+}
+
+// Suspends the watchdog whilst playback is paused
+func (w *watchdog) pause() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.paused = true
+}
+
+// Returns true if no audio has been delivered within the timeout
+func (w *watchdog) stalled() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timeout == 0 || w.paused {
+		return false
+	}
+	last := w.engine.LastWrite()
+	if last.Before(w.since) {
+		last = w.since
+	}
+	return time.Since(last) > w.timeout
+}
+
+// Runs f, giving up with err if it has not returned within the timeout. A
+// zero timeout waits forever. f is left running in the background after a
+// timeout as libspotify gives us no way to cancel it.
+func withTimeout(d time.Duration, err error, f func() error) error {
+	if d == 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case e := <-done:
+		return e
+	case <-time.After(d):
+		return err
+	}
+}
+
+// Returns the ticker interval used to check the watchdog
+func watchdogInterval(timeout time.Duration) time.Duration {
+	if timeout > 0 && timeout/4 < time.Second {
+		return timeout / 4
+	}
+	return time.Second
+}
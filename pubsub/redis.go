@@ -0,0 +1,120 @@
+// Redis Pub/Sub transport for control and player events
+
+package pubsub
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// Dials a new connection to Redis
+type DialFunc func() (redis.Conn, error)
+
+// Subscribes to control events and publishes player events over Redis Pub/Sub
+type Redis struct {
+	dial      DialFunc
+	channel   string      // channel to receive control events on
+	publishTo string      // channel to publish player events to
+	out       chan []byte // channel to send received events too
+	bus       *events.Bus // Bus to publish connection events to
+	lock      sync.Mutex  // Guards conn
+	conn      redis.Conn  // Connection used for publishing, nil until needed
+}
+
+// Subscribes to the control channel, passing messages on to the event
+// handler. Reconnects when the connection is lost, runs forever.
+func (r *Redis) Subscribe() {
+	log.Infof("Subscribing to Redis channel: %s", r.channel)
+	for {
+		conn, err := r.dial()
+		if err != nil {
+			log.Errorf("Redis Dial Error: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		psc := redis.PubSubConn{Conn: conn}
+		if err := psc.Subscribe(r.channel); err != nil {
+			log.Errorf("Redis Subscribe Error: %s", err)
+			psc.Close()
+			time.Sleep(time.Second)
+			continue
+		}
+		r.receive(psc)
+		psc.Close()
+		r.bus.Publish(events.NewConnectionEvent(r.channel, false))
+	}
+}
+
+// Reads messages from the subscription until the connection errors
+func (r *Redis) receive(psc redis.PubSubConn) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			r.out <- v.Data
+		case redis.Subscription:
+			log.Infof("Redis %s: %s", v.Kind, v.Channel)
+			if v.Kind == "subscribe" {
+				r.bus.Publish(events.NewConnectionEvent(r.channel, true))
+			}
+		case error:
+			log.Errorf("Redis Receive Error: %s", v)
+			return
+		}
+	}
+}
+
+// Publishes a player event to the events channel, reconnecting once if the
+// publishing connection has been lost
+func (r *Redis) Publish(e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for attempt := 0; ; attempt++ {
+		if r.conn == nil {
+			if r.conn, err = r.dial(); err != nil {
+				r.conn = nil
+				return err
+			}
+		}
+		_, err = r.conn.Do("PUBLISH", r.publishTo, payload)
+		if err == nil || attempt > 0 {
+			break
+		}
+		r.conn.Close()
+		r.conn = nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Debugf("PUBLISH %s: %s", r.publishTo, payload)
+
+	return nil
+}
+
+// Constructs a new Redis transport connecting to the address
+func New(addr string, channel string, publishTo string, out chan []byte, bus *events.Bus) *Redis {
+	return NewWithDialer(func() (redis.Conn, error) {
+		return redis.Dial("tcp", addr)
+	}, channel, publishTo, out, bus)
+}
+
+// Constructs a new Redis transport using the given dialer, this allows an
+// in process stand-in for Redis to be used
+func NewWithDialer(dial DialFunc, channel string, publishTo string, out chan []byte, bus *events.Bus) *Redis {
+	return &Redis{
+		dial:      dial,
+		channel:   channel,
+		publishTo: publishTo,
+		out:       out,
+		bus:       bus,
+	}
+}
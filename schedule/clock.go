@@ -0,0 +1,28 @@
+// Clock used to schedule actions
+
+package schedule
+
+import "time"
+
+// Tells the time, replacing it allows schedules to be run against a fake
+// clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock using the system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Returns a Clock using the system time
+func NewClock() Clock {
+	return realClock{}
+}
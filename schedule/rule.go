@@ -0,0 +1,132 @@
+// Scheduled Actions
+
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// Actions a rule can take
+const (
+	PAUSE_ACTION    string = "pause"    // Hold the player paused, resuming after the duration if set
+	RESUME_ACTION   string = "resume"   // Resume
+	VOLUME_ACTION   string = "volume"   // Set the volume
+	LOCK_ACTION     string = "lock"     // Stop accepting added tracks for the duration
+	FALLBACK_ACTION string = "fallback" // Play the playlist when there is nothing else to play for the duration
+)
+
+// User scheduled events are sent as
+const SCHEDULE_USER string = "scheduler"
+
+// An action taken at the times of a cron schedule. Pause, lock and fallback
+// rules with a duration are undone once it has passed.
+type Rule struct {
+	Name     string
+	Cron     string        // Standard 5 field cron spec or descriptor, e.g @daily
+	Action   string        // One of the *_ACTION constants
+	Volume   int           // Volume percentage for volume rules
+	Playlist []string      // Track uris for fallback rules
+	Duration time.Duration // How long the action lasts
+	schedule cron.Schedule
+}
+
+// Returns the next time the rule starts after t
+func (r *Rule) Next(t time.Time) time.Time {
+	return r.schedule.Next(t)
+}
+
+// Returns true if the rule is undone after its duration
+func (r *Rule) windowed() bool {
+	return r.Duration > 0 && r.Action != VOLUME_ACTION && r.Action != RESUME_ACTION
+}
+
+// Returns true if t is within a window the rule started before t
+func (r *Rule) active(t time.Time) bool {
+	if !r.windowed() {
+		return false
+	}
+	start := r.schedule.Next(t.Add(-r.Duration))
+	return !start.After(t)
+}
+
+// Returns the event that starts the action
+func (r *Rule) start(t time.Time) events.Event {
+	base := events.Base{User: SCHEDULE_USER, Timestamp: t.UTC()}
+	switch r.Action {
+	case PAUSE_ACTION:
+		base.Type = events.PAUSE_EVENT
+		return &events.PauseEvent{Base: base, Hold: true}
+	case RESUME_ACTION:
+		base.Type = events.RESUME_EVENT
+		return &events.ResumeEvent{Base: base}
+	case VOLUME_ACTION:
+		base.Type = events.VOLUME_EVENT
+		return &events.VolumeEvent{Base: base, Volume: r.Volume}
+	case LOCK_ACTION:
+		base.Type = events.LOCK_EVENT
+		return &events.LockEvent{Base: base, Locked: true}
+	case FALLBACK_ACTION:
+		base.Type = events.FALLBACK_EVENT
+		return &events.FallbackEvent{Base: base, Playlist: r.Playlist}
+	}
+	return nil
+}
+
+// Returns the event that undoes the action once its window ends
+func (r *Rule) end(t time.Time) events.Event {
+	base := events.Base{User: SCHEDULE_USER, Timestamp: t.UTC()}
+	switch r.Action {
+	case PAUSE_ACTION:
+		base.Type = events.RESUME_EVENT
+		return &events.ResumeEvent{Base: base}
+	case LOCK_ACTION:
+		base.Type = events.LOCK_EVENT
+		return &events.LockEvent{Base: base, Locked: false}
+	case FALLBACK_ACTION:
+		base.Type = events.FALLBACK_EVENT
+		return &events.FallbackEvent{Base: base}
+	}
+	return nil
+}
+
+// Constructs a new Rule, parsing its cron spec and checking the action
+func NewRule(name string, spec string, action string, volume int, playlist []string, duration time.Duration) (*Rule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %s: %s", name, err)
+	}
+
+	r := &Rule{
+		Name:     name,
+		Cron:     spec,
+		Action:   action,
+		Volume:   volume,
+		Playlist: playlist,
+		Duration: duration,
+		schedule: schedule,
+	}
+
+	switch action {
+	case PAUSE_ACTION, RESUME_ACTION:
+	case VOLUME_ACTION:
+		if volume < 0 || volume > 100 {
+			return nil, fmt.Errorf("schedule %s: invalid volume: %d", name, volume)
+		}
+	case LOCK_ACTION:
+		if duration <= 0 {
+			return nil, fmt.Errorf("schedule %s: lock needs a duration", name)
+		}
+	case FALLBACK_ACTION:
+		if duration <= 0 || len(playlist) == 0 {
+			return nil, fmt.Errorf("schedule %s: fallback needs a duration and playlist", name)
+		}
+	default:
+		return nil, fmt.Errorf("schedule %s: unknown action: %s", name, action)
+	}
+
+	return r, nil
+}
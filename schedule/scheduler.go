@@ -0,0 +1,103 @@
+// Scheduler sending events for rules at their scheduled times
+
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// A rule starting or ending at a time
+type occurrence struct {
+	at   time.Time
+	rule *Rule
+	end  bool
+}
+
+// Sends the events for rules to the event handler at their scheduled times,
+// the same path events from Perceptor take
+type Scheduler struct {
+	clock Clock
+	rules []*Rule
+	out   chan []byte // channel to send events too
+}
+
+// Runs the schedule until the context is done. Rules whose window is open
+// when the scheduler starts are started straight away.
+func (s *Scheduler) Run(ctx context.Context) {
+	now := s.clock.Now()
+	var pending []occurrence
+	for _, r := range s.rules {
+		if r.active(now) {
+			log.Infof("Schedule %s: active", r.Name)
+			s.send(ctx, r.start(now))
+			start := r.Next(now.Add(-r.Duration))
+			pending = append(pending, occurrence{at: start.Add(r.Duration), rule: r, end: true})
+		}
+		if at := r.Next(now); !at.IsZero() {
+			pending = append(pending, occurrence{at: at, rule: r})
+		}
+	}
+
+	for len(pending) > 0 {
+		// Wait for the earliest occurrence
+		next := 0
+		for i, o := range pending {
+			if o.at.Before(pending[next].at) {
+				next = i
+			}
+		}
+		o := pending[next]
+		select {
+		case <-s.clock.After(o.at.Sub(s.clock.Now())):
+		case <-ctx.Done():
+			return
+		}
+
+		if o.end {
+			log.Infof("Schedule %s: ended", o.rule.Name)
+			s.send(ctx, o.rule.end(o.at))
+			pending = append(pending[:next], pending[next+1:]...)
+			continue
+		}
+
+		log.Infof("Schedule %s: %s", o.rule.Name, o.rule.Action)
+		s.send(ctx, o.rule.start(o.at))
+		// Rules that never start again, e.g a date that has passed, are
+		// dropped
+		if at := o.rule.Next(o.at); at.IsZero() {
+			pending = append(pending[:next], pending[next+1:]...)
+		} else {
+			pending[next].at = at
+		}
+		if o.rule.windowed() {
+			pending = append(pending, occurrence{at: o.at.Add(o.rule.Duration), rule: o.rule, end: true})
+		}
+	}
+}
+
+// Sends an event to the event handler
+func (s *Scheduler) send(ctx context.Context, e events.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to marshal scheduled event: %s", err)
+		return
+	}
+	select {
+	case s.out <- payload:
+	case <-ctx.Done():
+	}
+}
+
+// Constructs a new Scheduler sending events to the channel
+func New(clock Clock, rules []*Rule, out chan []byte) *Scheduler {
+	return &Scheduler{
+		clock: clock,
+		rules: rules,
+		out:   out,
+	}
+}
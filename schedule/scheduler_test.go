@@ -0,0 +1,165 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+// Clock only moving when the test moves it
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, t)
+	}
+	return t.c
+}
+
+// Waits for something to be waiting on the clock, then moves it to the time
+func (c *fakeClock) advance(t *testing.T, to time.Time) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.lock.Lock()
+		if len(c.waiters) > 0 {
+			break
+		}
+		c.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("nothing waiting on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer c.lock.Unlock()
+
+	c.now = to
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(to) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- to
+		}
+	}
+	c.waiters = waiters
+}
+
+// Starts the scheduler, stopped when the test ends
+func startScheduler(t *testing.T, clock Clock, rules ...*Rule) chan []byte {
+	out := make(chan []byte, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		New(clock, rules, out).Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return out
+}
+
+// Waits for the scheduler to send an event of the type at the time
+func expectEvent(t *testing.T, out chan []byte, eventType string, at time.Time) {
+	t.Helper()
+	select {
+	case payload := <-out:
+		b := &events.Base{}
+		if err := json.Unmarshal(payload, b); err != nil {
+			t.Fatalf("bad event %s: %s", payload, err)
+		}
+		if b.Type != eventType || !b.Timestamp.Equal(at) || b.User != SCHEDULE_USER {
+			t.Errorf("got %s, want %s event at %s", payload, eventType, at)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no %s event sent", eventType)
+	}
+}
+
+// Fails if the scheduler has sent an event
+func expectNoEvent(t *testing.T, out chan []byte) {
+	t.Helper()
+	select {
+	case payload := <-out:
+		t.Errorf("unexpected event %s", payload)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Pauses between 10am and 11am every day
+func pauseRule(t *testing.T) *Rule {
+	r, err := NewRule("quiet", "0 10 * * *", PAUSE_ACTION, 0, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func at(hour, min int) time.Time {
+	return time.Date(2015, time.June, 1, hour, min, 0, 0, time.Local)
+}
+
+func TestWindowStartAndEnd(t *testing.T) {
+	clock := &fakeClock{now: at(9, 0)}
+	out := startScheduler(t, clock, pauseRule(t))
+	expectNoEvent(t, out)
+
+	clock.advance(t, at(10, 0))
+	expectEvent(t, out, events.PAUSE_EVENT, at(10, 0))
+
+	clock.advance(t, at(11, 0))
+	expectEvent(t, out, events.RESUME_EVENT, at(11, 0))
+
+	// And again the next day
+	clock.advance(t, at(34, 0))
+	expectEvent(t, out, events.PAUSE_EVENT, at(34, 0))
+}
+
+func TestWindowOpenAtStart(t *testing.T) {
+	clock := &fakeClock{now: at(10, 30)}
+	out := startScheduler(t, clock, pauseRule(t))
+	expectEvent(t, out, events.PAUSE_EVENT, at(10, 30))
+
+	clock.advance(t, at(11, 0))
+	expectEvent(t, out, events.RESUME_EVENT, at(11, 0))
+	expectNoEvent(t, out)
+}
+
+func TestWindowClosedAtStart(t *testing.T) {
+	clock := &fakeClock{now: at(11, 0)}
+	out := startScheduler(t, clock, pauseRule(t))
+	expectNoEvent(t, out)
+}
+
+func TestPauseHolds(t *testing.T) {
+	e, ok := pauseRule(t).start(at(10, 0)).(*events.PauseEvent)
+	if !ok || !e.Hold {
+		t.Errorf("got %+v, want a held pause", e)
+	}
+}
@@ -0,0 +1,164 @@
+// Versioned Request Signing and Verification
+
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client id requests are signed as by default
+const CLIENT_NAME string = "soundwave"
+
+// Signing scheme versions
+const (
+	V1 int = 1 // <client>:<hmac of body>
+	V2 int = 2 // v2:<client>:<unix timestamp>:<nonce>:<hmac of method, path, timestamp, nonce and body>
+)
+
+// Reasons a signature is rejected
+var (
+	ErrMalformedSignature = errors.New("malformed signature")
+	ErrUnknownClient      = errors.New("unknown client")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrStaleSignature     = errors.New("signature timestamp out of range")
+	ErrReplayedSignature  = errors.New("signature already used")
+)
+
+// Signs and verifies requests with a shared secret. Requests are signed with
+// the first secret and verified with any of them, so secrets can be rotated
+// by adding the new secret first and removing the old one once every client
+// has moved over.
+type Signer struct {
+	Version  int
+	ClientId string
+	Secrets  []string
+	MaxAge   time.Duration // V2 timestamps further than this from now are rejected, 0 accepts any
+	lock     sync.Mutex
+	seen     map[string]time.Time // V2 signatures verified within the max age
+}
+
+// Returns the HMAC of the parts with the secret
+func mac(secret string, parts ...[]byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	for i, part := range parts {
+		if i > 0 {
+			m.Write([]byte("\n"))
+		}
+		m.Write(part)
+	}
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Returns the V2 HMAC of the request
+func macV2(secret string, method string, path string, ts string, nonce string, body []byte) string {
+	return mac(secret, []byte(method), []byte(path), []byte(ts), []byte(nonce), body)
+}
+
+// Returns a random nonce so identical requests made in the same second have
+// different signatures
+func nonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Signs a request made at t, the method and path are ignored by V1
+func (s *Signer) Sign(method string, path string, body []byte, t time.Time) string {
+	if s.Version < V2 {
+		return fmt.Sprintf("%s:%s", s.ClientId, mac(s.Secrets[0], body))
+	}
+	ts := strconv.FormatInt(t.Unix(), 10)
+	n := nonce()
+	return fmt.Sprintf("v2:%s:%s:%s:%s", s.ClientId, ts, n, macV2(s.Secrets[0], method, path, ts, n, body))
+}
+
+// Verifies the signature of a request received at now. V2 signatures are
+// required unless the signer is V1, and each V2 signature is only accepted
+// once.
+func (s *Signer) Verify(method string, path string, body []byte, sig string, now time.Time) error {
+	if !strings.HasPrefix(sig, "v2:") {
+		if s.Version >= V2 {
+			return ErrMalformedSignature
+		}
+		parts := strings.SplitN(sig, ":", 2)
+		if len(parts) != 2 {
+			return ErrMalformedSignature
+		}
+		if parts[0] != s.ClientId {
+			return ErrUnknownClient
+		}
+		return s.match(parts[1], func(secret string) string {
+			return mac(secret, body)
+		})
+	}
+
+	parts := strings.SplitN(sig, ":", 5)
+	if len(parts) != 5 || parts[3] == "" {
+		return ErrMalformedSignature
+	}
+	if parts[1] != s.ClientId {
+		return ErrUnknownClient
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return ErrMalformedSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); s.MaxAge > 0 && (age > s.MaxAge || age < -s.MaxAge) {
+		return ErrStaleSignature
+	}
+	if err := s.match(parts[4], func(secret string) string {
+		return macV2(secret, method, path, parts[2], parts[3], body)
+	}); err != nil {
+		return err
+	}
+	return s.once(sig, now)
+}
+
+// Returns nil if the HMAC matches the HMAC for any secret
+func (s *Signer) match(got string, expected func(secret string) string) error {
+	for _, secret := range s.Secrets {
+		if hmac.Equal([]byte(got), []byte(expected(secret))) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Rejects signatures that have already been seen, forgetting them once
+// they are too old to pass the timestamp check. With no max age every
+// timestamp passes, so signatures are never forgotten.
+func (s *Signer) once(sig string, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for seen, at := range s.seen {
+		if s.MaxAge > 0 && now.Sub(at) > 2*s.MaxAge {
+			delete(s.seen, seen)
+		}
+	}
+	if _, ok := s.seen[sig]; ok {
+		return ErrReplayedSignature
+	}
+	s.seen[sig] = now
+	return nil
+}
+
+// Constructs a new Signer, the first secret signs requests
+func NewSigner(version int, clientId string, secrets []string, maxAge time.Duration) *Signer {
+	return &Signer{
+		Version:  version,
+		ClientId: clientId,
+		Secrets:  secrets,
+		MaxAge:   maxAge,
+		seen:     make(map[string]time.Time),
+	}
+}
@@ -0,0 +1,83 @@
+package signature
+
+import (
+	"testing"
+	"time"
+)
+
+// V2 signatures with timestamps outside the max age are rejected
+func TestStaleSignature(t *testing.T) {
+	s := NewSigner(V2, CLIENT_NAME, []string{"secret"}, time.Minute)
+	now := time.Now()
+	body := []byte(`{"uri":"spotify:track:a"}`)
+
+	for _, signed := range []time.Time{now.Add(-2 * time.Minute), now.Add(2 * time.Minute)} {
+		sig := s.Sign("POST", "/events/play", body, signed)
+		if err := s.Verify("POST", "/events/play", body, sig, now); err != ErrStaleSignature {
+			t.Errorf("signed %s from now: got %v", signed.Sub(now), err)
+		}
+	}
+	sig := s.Sign("POST", "/events/play", body, now.Add(-30*time.Second))
+	if err := s.Verify("POST", "/events/play", body, sig, now); err != nil {
+		t.Errorf("signed 30s ago: %s", err)
+	}
+}
+
+// Each V2 signature is only accepted once, whatever the max age
+func TestReplayedSignature(t *testing.T) {
+	for _, maxAge := range []time.Duration{time.Minute, 0} {
+		s := NewSigner(V2, CLIENT_NAME, []string{"secret"}, maxAge)
+		now := time.Now()
+		body := []byte(`{"uri":"spotify:track:a"}`)
+		sig := s.Sign("POST", "/events/play", body, now)
+
+		if err := s.Verify("POST", "/events/play", body, sig, now); err != nil {
+			t.Fatalf("max age %s: %s", maxAge, err)
+		}
+		// A second request with its own signature is fine
+		other := s.Sign("POST", "/events/play", body, now)
+		if err := s.Verify("POST", "/events/play", body, other, now); err != nil {
+			t.Errorf("max age %s: %s", maxAge, err)
+		}
+		if err := s.Verify("POST", "/events/play", body, sig, now.Add(time.Second)); err != ErrReplayedSignature {
+			t.Errorf("max age %s: replay got %v", maxAge, err)
+		}
+	}
+}
+
+// Signatures made with a previous secret verify until it is removed
+func TestPreviousSecret(t *testing.T) {
+	old := NewSigner(V2, CLIENT_NAME, []string{"old"}, time.Minute)
+	rotated := NewSigner(V2, CLIENT_NAME, []string{"new", "old"}, time.Minute)
+	removed := NewSigner(V2, CLIENT_NAME, []string{"new"}, time.Minute)
+	now := time.Now()
+	body := []byte(`{}`)
+
+	sig := old.Sign("GET", "/playlist/next", body, now)
+	if err := rotated.Verify("GET", "/playlist/next", body, sig, now); err != nil {
+		t.Errorf("previous secret: %s", err)
+	}
+	if err := removed.Verify("GET", "/playlist/next", body, sig, now); err != ErrInvalidSignature {
+		t.Errorf("removed secret: got %v", err)
+	}
+	sig = rotated.Sign("GET", "/playlist/next", body, now)
+	if err := removed.Verify("GET", "/playlist/next", body, sig, now); err != nil {
+		t.Errorf("signed with new secret: %s", err)
+	}
+}
+
+// V2 signers reject V1 signatures, which have no timestamp or nonce
+func TestV1RejectedByV2(t *testing.T) {
+	v1 := NewSigner(V1, CLIENT_NAME, []string{"secret"}, time.Minute)
+	v2 := NewSigner(V2, CLIENT_NAME, []string{"secret"}, time.Minute)
+	now := time.Now()
+	body := []byte(`{}`)
+
+	sig := v1.Sign("POST", "/events/end", body, now)
+	if err := v1.Verify("POST", "/events/end", body, sig, now); err != nil {
+		t.Errorf("V1 signer: %s", err)
+	}
+	if err := v2.Verify("POST", "/events/end", body, sig, now); err != ErrMalformedSignature {
+		t.Errorf("V2 signer: got %v", err)
+	}
+}
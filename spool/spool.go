@@ -0,0 +1,173 @@
+// Persistent FIFO queue of messages, one file per message
+
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Extension of message files
+const EXT string = ".json"
+
+// A queued message
+type Item struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Queues messages in a directory so they survive restarts. The oldest
+// messages are dropped once the spool is full. A Spool without a directory
+// only keeps messages in memory.
+type Spool struct {
+	lock  sync.Mutex
+	dir   string
+	max   int     // Max messages kept, 0 is unlimited
+	items []*Item // Queued messages, oldest first
+	seq   uint64  // Sequence of the last message pushed
+	ready chan struct{}
+}
+
+// Adds a message to the back of the queue
+func (s *Spool) Push(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	item := &Item{Seq: s.seq, Data: data}
+	if s.dir != "" {
+		// Write to a temp file first so a crash never leaves half a message
+		tmp := s.path(item.Seq) + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, s.path(item.Seq)); err != nil {
+			return err
+		}
+	}
+	s.items = append(s.items, item)
+
+	// Drop the oldest messages once full
+	for s.max > 0 && len(s.items) > s.max {
+		log.Warnf("Spool %s full, dropped message %d", s.dir, s.items[0].Seq)
+		s.remove(s.items[0].Seq)
+	}
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Returns the message at the front of the queue, or nil if it is empty
+func (s *Spool) Peek() *Item {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.items) == 0 {
+		return nil
+	}
+	return s.items[0]
+}
+
+// Removes a message, once it has been delivered
+func (s *Spool) Remove(seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(seq)
+}
+
+// Removes a message, the lock must be held
+func (s *Spool) remove(seq uint64) error {
+	for i, item := range s.items {
+		if item.Seq == seq {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			break
+		}
+	}
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns the number of queued messages
+func (s *Spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items)
+}
+
+// Receives when a message is pushed, wait on it when the spool is empty
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Returns the path of a message file
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, EXT))
+}
+
+// Loads the messages already queued in the directory
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), EXT) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		data, err := ioutil.ReadFile(s.path(seq))
+		if err != nil {
+			return err
+		}
+		s.items = append(s.items, &Item{Seq: seq, Data: data})
+		s.seq = seq
+	}
+	return nil
+}
+
+// Opens the spool in the directory, creating it if needed and loading any
+// messages left from before. An empty directory keeps messages in memory.
+func Open(dir string, max int) (*Spool, error) {
+	s := &Spool{
+		dir:   dir,
+		max:   max,
+		ready: make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.items) > 0 {
+		log.Infof("Spool %s: %d messages queued", dir, len(s.items))
+		s.ready <- struct{}{}
+	}
+	return s, nil
+}
@@ -0,0 +1,113 @@
+// HTTP API for the Local Queue
+
+package standalone
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Body of a request adding a track
+type addRequest struct {
+	Uri  string `json:"uri"`
+	User string `json:"user"`
+}
+
+// Body of a request moving a track
+type moveRequest struct {
+	Position int `json:"position"`
+}
+
+// Serves the queue API:
+//
+//	GET    /queue      List the queued tracks, next first
+//	POST   /queue      Add a track, {"uri": "spotify:track:...", "user": "..."}
+//	DELETE /queue      Clear the queue
+//	PUT    /queue/<id> Move a track, {"position": 0} plays it next
+//	DELETE /queue/<id> Remove a track
+type API struct {
+	queue *Queue
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/queue"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		a.write(w, http.StatusOK, a.queue.Tracks())
+	case id == "" && r.Method == "POST":
+		a.add(w, r)
+	case id == "" && r.Method == "DELETE":
+		a.result(w, a.queue.Clear())
+	case id != "" && r.Method == "PUT":
+		a.move(w, r, id)
+	case id != "" && r.Method == "DELETE":
+		a.result(w, a.queue.Remove(id))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Adds a track to the back of the queue
+func (a *API) add(w http.ResponseWriter, r *http.Request) {
+	req := &addRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := a.queue.Add(req.Uri, req.User)
+	if err != nil {
+		a.result(w, err)
+		return
+	}
+	a.write(w, http.StatusCreated, t)
+}
+
+// Moves a track to a new position
+func (a *API) move(w http.ResponseWriter, r *http.Request, id string) {
+	req := &moveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.result(w, a.queue.Move(id, req.Position))
+}
+
+// Responds with the queue, or the error changing it
+func (a *API) result(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		a.write(w, http.StatusOK, a.queue.Tracks())
+	case ErrTrackNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrMissingUri:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Errorf("Queue error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Writes v as JSON
+func (a *API) write(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Constructs a new API for the queue, mount it on /queue and /queue/
+func NewAPI(q *Queue) *API {
+	return &API{queue: q}
+}
+
+// Serves the queue API on the address
+func Serve(addr string, q *Queue) error {
+	api := NewAPI(q)
+	mux := http.NewServeMux()
+	mux.Handle("/queue", api)
+	mux.Handle("/queue/", api)
+	log.Infof("Serving queue API on: %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
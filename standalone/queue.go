@@ -0,0 +1,240 @@
+// Local Queue for running without Perceptor
+
+package standalone
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/perceptor"
+)
+
+// User tracks added without a user are queued for
+const LOCAL_USER string = "local"
+
+// Queue errors
+var (
+	ErrEmptyQueue    = errors.New("queue is empty")
+	ErrTrackNotFound = errors.New("track not found")
+	ErrMissingUri    = errors.New("missing uri")
+)
+
+// An in process queue of tracks standing in for Perceptor, saved to a file
+// after every change so it survives restarts. Player events are only logged.
+type Queue struct {
+	lock   sync.Mutex
+	path   string             // File the queue is saved to, empty keeps it in memory
+	tracks []*perceptor.Track // Queued tracks, next first
+	bus    *events.Bus        // Add events are published to wake the player
+}
+
+var _ perceptor.Client = (*Queue)(nil)
+
+// Returns the next track, removing it from the queue. The track is still
+// played if the queue can not be saved, it is played again after a restart.
+func (q *Queue) Next() (*perceptor.Track, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.tracks) == 0 {
+		return nil, ErrEmptyQueue
+	}
+	t := q.tracks[0]
+	q.tracks = q.tracks[1:]
+	if err := q.save(); err != nil {
+		log.Errorf("Queue: Failed to save: %s", err)
+	}
+	return t, nil
+}
+
+func (q *Queue) Play(t *perceptor.Track, start time.Time) {
+	log.Infof("Queue: Playing %s for %s", t.Uri, t.User)
+}
+
+func (q *Queue) Pause(start time.Time) {
+	log.Info("Queue: Paused")
+}
+
+func (q *Queue) Resume(duration int64) {
+	log.Infof("Queue: Resumed after %dms", duration)
+}
+
+func (q *Queue) End(t *perceptor.Track) {
+	log.Infof("Queue: Ended %s", t.Uri)
+}
+
+func (q *Queue) Error(t *perceptor.Track, stage string, message string) {
+	log.Errorf("Queue: Failed to play %s at %s: %s", t.Uri, stage, message)
+}
+
+// The queue is controlled through the API rather than a stream of events
+func (q *Queue) WSConnection(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// Returns the queued tracks, next first
+func (q *Queue) Tracks() []*perceptor.Track {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	tracks := make([]*perceptor.Track, len(q.tracks))
+	copy(tracks, q.tracks)
+	return tracks
+}
+
+// Adds a track to the back of the queue, waking the player if it is waiting
+// for a track. The track is not added if the queue can not be saved.
+func (q *Queue) Add(uri string, user string) (*perceptor.Track, error) {
+	if uri == "" {
+		return nil, ErrMissingUri
+	}
+	if user == "" {
+		user = LOCAL_USER
+	}
+	t := &perceptor.Track{Id: newId(), Uri: uri, User: user}
+
+	q.lock.Lock()
+	previous := q.copy()
+	q.tracks = append(q.tracks, t)
+	err := q.saveOr(previous)
+	q.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	q.bus.Publish(&events.AddEvent{
+		Base: events.Base{
+			Type:      events.ADD_EVENT,
+			User:      user,
+			Timestamp: time.Now().UTC(),
+		},
+		Track: t.Id,
+		Uri:   t.Uri,
+	})
+	return t, nil
+}
+
+// Removes a track from the queue, unless the queue can not be saved
+func (q *Queue) Remove(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	i := q.index(id)
+	if i < 0 {
+		return ErrTrackNotFound
+	}
+	previous := q.copy()
+	q.tracks = append(q.tracks[:i], q.tracks[i+1:]...)
+	return q.saveOr(previous)
+}
+
+// Moves a track to the position in the queue, 0 plays it next. Positions
+// past the end move it to the back. The track is not moved if the queue can
+// not be saved.
+func (q *Queue) Move(id string, position int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	i := q.index(id)
+	if i < 0 {
+		return ErrTrackNotFound
+	}
+	previous := q.copy()
+	t := q.tracks[i]
+	q.tracks = append(q.tracks[:i], q.tracks[i+1:]...)
+	if position < 0 {
+		position = 0
+	}
+	if position > len(q.tracks) {
+		position = len(q.tracks)
+	}
+	q.tracks = append(q.tracks[:position], append([]*perceptor.Track{t}, q.tracks[position:]...)...)
+	return q.saveOr(previous)
+}
+
+// Removes every track from the queue, unless the queue can not be saved
+func (q *Queue) Clear() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	previous := q.copy()
+	q.tracks = nil
+	return q.saveOr(previous)
+}
+
+// Returns the index of the track, or -1. The lock must be held.
+func (q *Queue) index(id string) int {
+	for i, t := range q.tracks {
+		if t.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns a copy of the queued tracks. The lock must be held.
+func (q *Queue) copy() []*perceptor.Track {
+	return append([]*perceptor.Track(nil), q.tracks...)
+}
+
+// Saves the queue, restoring the previous tracks if it can not be saved so a
+// change the caller is told failed is never kept. The lock must be held.
+func (q *Queue) saveOr(previous []*perceptor.Track) error {
+	err := q.save()
+	if err != nil {
+		q.tracks = previous
+	}
+	return err
+}
+
+// Saves the queue, writing to a temporary file first so a crash can not
+// leave it half written. The lock must be held.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.tracks)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Returns a new random track id
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Opens the queue saved in the file, creating it if needed. An empty path
+// keeps the queue in memory.
+func Open(path string, bus *events.Bus) (*Queue, error) {
+	q := &Queue{
+		path: path,
+		bus:  bus,
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, q.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.tracks); err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d queued tracks from %s", len(q.tracks), path)
+	return q, nil
+}
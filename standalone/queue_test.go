@@ -0,0 +1,79 @@
+package standalone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+)
+
+func TestNextSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := Open(filepath.Join(dir, "queue.json"), events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := q.Add("spotify:track:a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The track is still played if the queue can not be saved
+	q.path = filepath.Join(dir, "missing", "queue.json")
+	track, err := q.Next()
+	if err != nil || track == nil || track.Id != added.Id {
+		t.Fatalf("got %+v, %v, want track %s", track, err, added.Id)
+	}
+	if _, err := q.Next(); err != ErrEmptyQueue {
+		t.Errorf("got %v, want %v", err, ErrEmptyQueue)
+	}
+}
+
+// Changes are undone when the queue can not be saved, so a client retrying
+// a failed request does not add the track twice
+func TestChangeSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := Open(filepath.Join(dir, "queue.json"), events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := q.Add("spotify:track:a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := q.Add("spotify:track:b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.path = filepath.Join(dir, "missing", "queue.json")
+	if _, err := q.Add("spotify:track:c", ""); err == nil {
+		t.Error("add saved")
+	}
+	if err := q.Remove(a.Id); err == nil {
+		t.Error("remove saved")
+	}
+	if err := q.Move(b.Id, 0); err == nil {
+		t.Error("move saved")
+	}
+	if err := q.Clear(); err == nil {
+		t.Error("clear saved")
+	}
+
+	tracks := q.Tracks()
+	if len(tracks) != 2 || tracks[0].Id != a.Id || tracks[1].Id != b.Id {
+		t.Errorf("got %+v, want tracks %s and %s", tracks, a.Id, b.Id)
+	}
+}
@@ -0,0 +1,43 @@
+// TLS Configuration shared by clients
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Paths and names used to build a TLS config
+type Config struct {
+	CA         string // Path to CA bundle to verify the server with, system CAs when empty
+	Cert       string // Path to client certificate for mutual TLS
+	Key        string // Path to client certificate key
+	ServerName string // Overrides the server name verified
+}
+
+// Builds the TLS config, loading the CA bundle and client certificate
+func (c Config) Load() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.ServerName,
+	}
+	if c.CA != "" {
+		ca, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + c.CA)
+		}
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,117 @@
+// Outbound webhooks for player events
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thisissoon/FM-SoundWave/delivery"
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/spool"
+)
+
+// A webhook events are POSTed to
+type Hook struct {
+	Name   string
+	URL    string
+	Signer *signature.Signer // Signs requests in the Signature header when set
+	Events []string          // Event types to send, all player events when empty
+}
+
+// Queues player events and delivers them to a webhook, retrying with
+// backoff until they are delivered or rejected
+type Webhook struct {
+	hook   Hook
+	spool  *spool.Spool
+	client *http.Client
+}
+
+// Returns true if the hook wants the event type
+func (w *Webhook) wants(eventType string) bool {
+	if len(w.hook.Events) == 0 {
+		return true
+	}
+	for _, t := range w.hook.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues the event for delivery if the hook wants it
+func (w *Webhook) Send(e events.Event) error {
+	if !w.wants(e.Header().Type) {
+		return nil
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return w.spool.Push(payload)
+}
+
+// Delivers queued events in order until the context is done
+func (w *Webhook) Run(ctx context.Context) {
+	delivery.Run(ctx, w.spool, w.post, w.sent)
+}
+
+// Blocks until every queued event has been delivered or the context is done
+func (w *Webhook) Flush(ctx context.Context) error {
+	return delivery.Flush(ctx, w.spool)
+}
+
+// Logs the outcome of sending an event
+func (w *Webhook) sent(payload []byte, err error, retry time.Duration) {
+	switch {
+	case retry > 0:
+		log.Warnf("Webhook %s failed, retrying in %s: %s", w.hook.Name, retry, err)
+	case err != nil:
+		log.Errorf("Webhook %s rejected %s: %s", w.hook.Name, payload, err)
+	}
+}
+
+// POSTs the payload to the hook
+func (w *Webhook) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequest("POST", w.hook.URL, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if w.hook.Signer != nil {
+		req.Header.Add("Signature", w.hook.Signer.Sign("POST", req.URL.Path, payload, time.Now()))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	log.Infof("POST %s: %v", w.hook.URL, resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &delivery.StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Constructs a new Webhook queuing events in the spool
+func New(h Hook, s *spool.Spool) *Webhook {
+	return &Webhook{
+		hook:  h,
+		spool: s,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thisissoon/FM-SoundWave/events"
+	"github.com/thisissoon/FM-SoundWave/signature"
+	"github.com/thisissoon/FM-SoundWave/spool"
+)
+
+func TestSigned(t *testing.T) {
+	for _, version := range []int{signature.V1, signature.V2} {
+		signer := signature.NewSigner(version, "fm", []string{"secret"}, time.Minute)
+		verified := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			verified <- signer.Verify(r.Method, r.URL.Path, body, r.Header.Get("Signature"), time.Now())
+		}))
+
+		s, _ := spool.Open("", 0)
+		w := New(Hook{Name: "test", URL: server.URL + "/hook", Signer: signer}, s)
+		ctx, cancel := context.WithCancel(context.Background())
+		go w.Run(ctx)
+		w.Send(&events.EndEvent{Base: events.Base{Type: events.END_EVENT}, Uri: "spotify:track:a"})
+
+		select {
+		case err := <-verified:
+			if err != nil {
+				t.Errorf("v%d: %s", version, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("v%d: webhook not sent", version)
+		}
+		cancel()
+		server.Close()
+	}
+}